@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// accessLog logs every request once it completes. The format is up to the
+// handler behind logger, e.g. slog.NewTextHandler or slog.NewJSONHandler.
+// The request ID in requestIDHeader is included, if there is one, and so is
+// the ShadowIDHeader of shadowed requests. Entries are logged at a level to
+// match the response status; see statusLevel.
+func accessLog(logger *slog.Logger, requestIDHeader string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.code()),
+				slog.Int64("bytes", rec.written),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("client", clientIP(r)),
+			}
+			if id := r.Header.Get(requestIDHeader); id != "" {
+				attrs = append(attrs, slog.String("request_id", id))
+			}
+			if id := r.Header.Get(ShadowIDHeader); id != "" {
+				attrs = append(attrs, slog.String("shadow_id", id))
+			}
+			logger.LogAttrs(r.Context(), statusLevel(rec.code()), "request", attrs...)
+		})
+	}
+}
+
+// statusLevel logs 5xx responses as errors, 4xx as warnings and anything
+// else as info.
+func statusLevel(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
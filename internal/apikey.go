@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// keyRing hands out upstream API keys, moving on to the next key when the
+// current one is rejected. In round-robin mode, every request takes the next
+// key in turn, spreading load (and quota) across all keys.
+type keyRing struct {
+	keys       []string
+	roundRobin bool
+
+	mu      sync.Mutex
+	current int
+}
+
+func newKeyRing(keys []string, roundRobin bool) *keyRing {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &keyRing{keys: keys, roundRobin: roundRobin}
+}
+
+// get returns the key to use for a new request and its index.
+func (k *keyRing) get() (int, string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	i := k.current
+	if k.roundRobin {
+		k.current = (k.current + 1) % len(k.keys)
+	}
+	return i, k.keys[i]
+}
+
+// rotate returns the key to retry with after the key at index failed was rejected.
+// Outside round-robin mode, the failed key is also retired for future requests,
+// unless another request already moved past it.
+func (k *keyRing) rotate(failed int) (int, string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	next := (failed + 1) % len(k.keys)
+	if k.roundRobin {
+		return next, k.keys[next]
+	}
+	if k.current == failed {
+		k.current = next
+	}
+	return k.current, k.keys[k.current]
+}
+
+type apiKeyKey struct{}
+
+// withAPIKeyIndex marks a request as carrying the key at index i from the ring.
+func withAPIKeyIndex(ctx context.Context, i int) context.Context {
+	return context.WithValue(ctx, apiKeyKey{}, i)
+}
+
+func apiKeyIndexFromContext(ctx context.Context) (int, bool) {
+	i, ok := ctx.Value(apiKeyKey{}).(int)
+	return i, ok
+}
+
+// apiKeyTransport moves on to the next API key when the upstream rejects the
+// current one with 401 or 403 (e.g. a revoked key), retrying idempotent requests
+// with it.
+// Only requests whose key we injected are retried; client credentials are left alone.
+type apiKeyTransport struct {
+	next    http.RoundTripper
+	ring    *keyRing
+	limiter *retryLimiter
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	index, injected := apiKeyIndexFromContext(req.Context())
+	if !injected || err != nil || !isAuthFailure(resp) {
+		return resp, err
+	}
+	if !isIdempotent(req) {
+		// can't be retried, but later requests shouldn't keep using the rejected key.
+		t.ring.rotate(index)
+		return resp, err
+	}
+
+	for attempt := 1; attempt < len(t.ring.keys) && err == nil && isAuthFailure(resp) && t.limiter.allow(req); attempt++ {
+		resp.Body.Close()
+
+		var key string
+		index, key = t.ring.rotate(index)
+
+		retry := req.Clone(withAPIKeyIndex(req.Context(), index))
+		retry.Header.Set("Authorization", "Bearer "+key)
+		resp, err = t.next.RoundTrip(retry)
+	}
+	return resp, err
+}
+
+func isAuthFailure(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// UpstreamAttemptsHeader reports how many upstream attempts a response took,
+// when it took more than one.
+const UpstreamAttemptsHeader = "X-Upstream-Attempts"
+
+type attemptsKey struct{}
+
+// withAttempts attaches a counter of upstream attempts to ctx.
+func withAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, new(atomic.Int32))
+}
+
+func attemptsFromContext(ctx context.Context) int32 {
+	if n, ok := ctx.Value(attemptsKey{}).(*atomic.Int32); ok {
+		return n.Load()
+	}
+	return 0
+}
+
+// countingTransport counts every attempt made for a request. It sits beneath
+// the retrying transports, so each retry is counted.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if n, ok := req.Context().Value(attemptsKey{}).(*atomic.Int32); ok {
+		n.Add(1)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// setAttemptsHeader tells the client how many attempts were needed, if retried.
+func setAttemptsHeader(resp *http.Response) {
+	if n := attemptsFromContext(resp.Request.Context()); n > 1 {
+		resp.Header.Set(UpstreamAttemptsHeader, strconv.Itoa(int(n)))
+	}
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Balancer picks an upstream target for each request and learns from the outcome.
+type Balancer interface {
+	// Next returns the target the next request should be forwarded to.
+	Next() *url.URL
+	// Observe records how long a request to target took, and whether it failed.
+	Observe(target *url.URL, latency time.Duration, err error)
+}
+
+// WeightedTarget is an upstream with a static weight relative to its peers.
+type WeightedTarget struct {
+	URL    *url.URL
+	Weight float64
+
+	// HealthCheckPath and HealthyStatus override Config.HealthCheckPath and
+	// Config.HealthyStatus when probing this target. Zero values use the Config's.
+	HealthCheckPath string
+	HealthyStatus   int
+
+	// MaxConcurrent caps the requests in flight to this target, so a weaker
+	// backend isn't overwhelmed. Zero means no cap.
+	MaxConcurrent int
+}
+
+// AdaptiveBalancer is a weighted random balancer whose weights are scaled by
+// an exponentially weighted moving average (EWMA) of observed latency.
+// Faster backends receive proportionally more traffic.
+type AdaptiveBalancer struct {
+	// Decay is the weight given to each new latency sample, between 0 and 1.
+	// Higher values react faster to changes in backend latency.
+	Decay float64
+
+	mu      sync.Mutex
+	targets []*adaptiveTarget
+	// threshold consecutive failures eject a target for ejectFor; see
+	// WithEjectionThreshold. Zero never ejects.
+	threshold int
+	ejectFor  time.Duration
+}
+
+type adaptiveTarget struct {
+	url    *url.URL
+	weight float64
+	// healthPath and healthyStatus override the Config's health probe, if set.
+	healthPath    string
+	healthyStatus int
+	// ewma is the smoothed latency in seconds, zero until first observed.
+	ewma float64
+	// failures counts consecutive failed requests. Once it reaches the
+	// balancer's threshold the target is skipped until ejectedUntil.
+	failures     int
+	ejectedUntil time.Time
+	// inFlight counts requests sent to the target whose response hasn't been
+	// closed yet, against its maxConcurrent cap.
+	maxConcurrent int
+	inFlight      int
+}
+
+// NewAdaptiveBalancer creates a latency-aware balancer over targets.
+// Targets with a non-positive weight are given a weight of 1.
+func NewAdaptiveBalancer(targets ...WeightedTarget) *AdaptiveBalancer {
+	b := &AdaptiveBalancer{
+		Decay: 0.3,
+	}
+	for _, t := range targets {
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		b.targets = append(b.targets, &adaptiveTarget{url: t.URL, weight: weight, healthPath: t.HealthCheckPath, healthyStatus: t.HealthyStatus, maxConcurrent: t.MaxConcurrent})
+	}
+	return b
+}
+
+// Next picks a target at random, weighted by static weight divided by
+// smoothed latency. Targets without observations are scored optimistically
+// as the fastest known target so they get a chance to be measured.
+// Ejected targets and those at their MaxConcurrent cap are skipped. If that
+// leaves none, a target at capacity is chosen over an ejected one, and an
+// ejected one is tried anyway if nothing else is left.
+func (b *AdaptiveBalancer) Next() *url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.targets) == 0 {
+		return nil
+	}
+
+	t := b.pick(time.Now())
+	t.inFlight++
+	return t.url
+}
+
+func (b *AdaptiveBalancer) pick(now time.Time) *adaptiveTarget {
+	var live, available []*adaptiveTarget
+	for _, t := range b.targets {
+		if t.ejected(now) {
+			continue
+		}
+		live = append(live, t)
+		if t.maxConcurrent == 0 || t.inFlight < t.maxConcurrent {
+			available = append(available, t)
+		}
+	}
+
+	switch {
+	case len(available) > 0:
+		return b.weighted(available)
+	case len(live) > 0:
+		// everyone is busy: go over the cap of the least loaded target.
+		least := live[0]
+		for _, t := range live[1:] {
+			if float64(t.inFlight)/float64(t.maxConcurrent) < float64(least.inFlight)/float64(least.maxConcurrent) {
+				least = t
+			}
+		}
+		return least
+	}
+
+	soonest := b.targets[0]
+	for _, t := range b.targets[1:] {
+		if t.ejectedUntil.Before(soonest.ejectedUntil) {
+			soonest = t
+		}
+	}
+	return soonest
+}
+
+// weighted picks one of targets at random, weighted by static weight divided
+// by smoothed latency.
+func (b *AdaptiveBalancer) weighted(targets []*adaptiveTarget) *adaptiveTarget {
+	fastest := 0.0
+	for _, t := range targets {
+		if t.ewma > 0 && (fastest == 0 || t.ewma < fastest) {
+			fastest = t.ewma
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+
+	scores := make([]float64, len(targets))
+	total := 0.0
+	for i, t := range targets {
+		latency := t.ewma
+		if latency == 0 {
+			latency = fastest
+		}
+		scores[i] = t.weight / latency
+		total += scores[i]
+	}
+
+	pick := rand.Float64() * total
+	for i, score := range scores {
+		pick -= score
+		if pick < 0 {
+			return targets[i]
+		}
+	}
+	return targets[len(targets)-1]
+}
+
+// release marks a request to target returned by Next as finished.
+func (b *AdaptiveBalancer) release(target *url.URL) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, t := range b.targets {
+		if t.url == target && t.inFlight > 0 {
+			t.inFlight--
+			return
+		}
+	}
+}
+
+// failurePenalty is the least latency a failed request is counted as, so a
+// target failing fast doesn't look fast.
+const failurePenalty = time.Second
+
+// Observe folds latency into the target's moving average.
+// Failed requests count as twice the slowest recent observation, and at least
+// failurePenalty, and enough of them in a row eject the target.
+func (b *AdaptiveBalancer) Observe(target *url.URL, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sample := latency.Seconds()
+	if err != nil {
+		sample = max(sample, failurePenalty.Seconds())
+		for _, t := range b.targets {
+			sample = max(sample, 2*t.ewma)
+		}
+	}
+
+	for _, t := range b.targets {
+		if t.url != target {
+			continue
+		}
+		if t.ewma == 0 {
+			t.ewma = sample
+		} else {
+			t.ewma = b.Decay*sample + (1-b.Decay)*t.ewma
+		}
+
+		if err == nil {
+			t.failures = 0
+			t.ejectedUntil = time.Time{}
+			return
+		}
+		// a target back from ejection is still over the threshold, so the
+		// first request to it acts as a probe: one more failure ejects it again.
+		t.failures++
+		if b.threshold > 0 && t.failures >= b.threshold {
+			t.ejectedUntil = time.Now().Add(b.ejectFor)
+		}
+		return
+	}
+}
+
+type targetKey struct{}
+
+// withTarget records the balancer's chosen target on the request context,
+// so the transport can report the outcome against it.
+func withTarget(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+func targetFromContext(ctx context.Context) *url.URL {
+	target, _ := ctx.Value(targetKey{}).(*url.URL)
+	return target
+}
+
+// observingTransport reports the latency of each upstream round trip to a
+// Balancer. 5xx responses are reported as failures.
+type observingTransport struct {
+	next     http.RoundTripper
+	balancer Balancer
+}
+
+func (t *observingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	target := targetFromContext(req.Context())
+	if target == nil {
+		return resp, err
+	}
+	failure := err
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		failure = fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	t.balancer.Observe(target, time.Since(start), failure)
+
+	// the request holds its place in the target's concurrency cap until the
+	// response, which may be a long stream, has been read.
+	if b, ok := t.balancer.(*AdaptiveBalancer); ok {
+		if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			// upgraded connections need their raw body, and aren't counted.
+			b.release(target)
+		} else {
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { b.release(target) }}
+		}
+	}
+	return resp, err
+}
+
+// releasingBody calls release once, when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
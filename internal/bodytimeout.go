@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+)
+
+// bodyReadTimeout bounds how long a client may take to upload the request body,
+// independent of the header timeouts, to defend against slow uploads.
+// The deadline replaces the server's ReadTimeout for the rest of the request.
+func bodyReadTimeout(d time.Duration, cfg *Config) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil && r.Body != http.NoBody {
+				deadline := time.Now().Add(d)
+				// don't extend past an overall request deadline.
+				if dl, ok := r.Context().Deadline(); ok && dl.Before(deadline) {
+					deadline = dl
+				}
+				if err := http.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+					cfg.Logger.Printf("failed to set body read deadline: %s", err)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// BroadcastHeader names the stream a request subscribes to. Requests naming
+// the same stream with the same credentials share a single upstream request
+// and all receive its response as it streams. IDs should still be unguessable,
+// since clients without credentials of their own share the proxy's.
+const BroadcastHeader = "X-Broadcast-Stream"
+
+// subscriberBuffer is how many writes a subscriber may fall behind before
+// it's dropped, so one slow client can't stall the stream for everyone.
+const subscriberBuffer = 64
+
+// broadcastHub fans out upstream streams to every subscriber with the same ID.
+type broadcastHub struct {
+	next http.Handler
+
+	mu      sync.Mutex
+	streams map[string]*broadcastStream
+}
+
+func broadcast(next http.Handler) http.Handler {
+	return &broadcastHub{next: next, streams: map[string]*broadcastStream{}}
+}
+
+func (h *broadcastHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(BroadcastHeader)
+	if id == "" || r.Method != http.MethodGet {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Del(BroadcastHeader)
+	// subscribers joining a stream aren't forwarded upstream, so only share
+	// streams started with the same credentials.
+	id += "\x00" + credentialKey(r)
+
+	stream, sub := h.subscribe(id, r)
+	defer h.unsubscribe(id, stream, sub)
+
+	select {
+	case <-stream.ready:
+	case <-r.Context().Done():
+		return
+	}
+
+	for k, vv := range stream.sent {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(stream.status)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	for {
+		select {
+		case b, ok := <-sub.events:
+			if !ok {
+				if sub.cut {
+					// reset the connection, so the client can tell the stream didn't finish.
+					panic(http.ErrAbortHandler)
+				}
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// subscribe joins the stream for id, starting it with r if it isn't running.
+func (h *broadcastHub) subscribe(id string, r *http.Request) (*broadcastStream, *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[id]
+	if !ok {
+		// the upstream request outlives whichever client happened to start it.
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		stream = &broadcastStream{
+			header:      http.Header{},
+			ready:       make(chan struct{}),
+			cancel:      cancel,
+			subscribers: map[*subscriber]struct{}{},
+		}
+		h.streams[id] = stream
+		go func() {
+			failed := true
+			defer func() {
+				// ReverseProxy aborts with a panic when the upstream body fails
+				// midway, which nothing above this goroutine would recover.
+				v := recover()
+				h.end(id, stream, failed)
+				if v != nil && v != http.ErrAbortHandler {
+					panic(v)
+				}
+			}()
+			h.next.ServeHTTP(stream, r.WithContext(ctx))
+			failed = false
+		}()
+	}
+
+	sub := &subscriber{events: make(chan []byte, subscriberBuffer)}
+	stream.mu.Lock()
+	stream.subscribers[sub] = struct{}{}
+	stream.mu.Unlock()
+	return stream, sub
+}
+
+// unsubscribe leaves the stream, canceling the upstream request if sub was
+// the last subscriber.
+func (h *broadcastHub) unsubscribe(id string, stream *broadcastStream, sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream.mu.Lock()
+	delete(stream.subscribers, sub)
+	empty := len(stream.subscribers) == 0
+	stream.mu.Unlock()
+
+	if empty {
+		stream.cancel()
+		if h.streams[id] == stream {
+			delete(h.streams, id)
+		}
+	}
+}
+
+// end closes every subscriber once the upstream response is over, cutting
+// them off if it failed.
+func (h *broadcastHub) end(id string, stream *broadcastStream, failed bool) {
+	h.mu.Lock()
+	if h.streams[id] == stream {
+		delete(h.streams, id)
+	}
+	h.mu.Unlock()
+
+	stream.WriteHeader(http.StatusOK)
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for sub := range stream.subscribers {
+		sub.cut = failed
+		close(sub.events)
+		delete(stream.subscribers, sub)
+	}
+	stream.cancel()
+}
+
+// broadcastStream is the http.ResponseWriter the shared upstream response is
+// written to. Each write is copied to every subscriber.
+type broadcastStream struct {
+	header http.Header
+	// sent and status are the headers and status as of WriteHeader.
+	sent   http.Header
+	status int
+	// ready is closed once the status and headers are known.
+	ready  chan struct{}
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber receives a copy of each write to a stream until events is
+// closed. cut is set first if it missed the end of the stream.
+type subscriber struct {
+	events chan []byte
+	cut    bool
+}
+
+func (s *broadcastStream) Header() http.Header {
+	return s.header
+}
+
+func (s *broadcastStream) WriteHeader(code int) {
+	// informational responses aren't relayed to subscribers.
+	if code < 200 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		return
+	}
+	s.status = code
+	s.sent = s.header.Clone()
+	close(s.ready)
+}
+
+func (s *broadcastStream) Write(b []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.events <- append([]byte(nil), b...):
+		default:
+			// too far behind; cut it off rather than block everyone else.
+			sub.cut = true
+			close(sub.events)
+			delete(s.subscribers, sub)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush is a no-op; subscribers flush after every write they relay.
+func (s *broadcastStream) Flush() {}
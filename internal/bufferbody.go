@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+type bufferedBodyKey struct{}
+
+// bodyBuffered reports whether the request's body was buffered by
+// bufferBody, and so can be replayed for a retry.
+func bodyBuffered(ctx context.Context) bool {
+	buffered, _ := ctx.Value(bufferedBodyKey{}).(bool)
+	return buffered
+}
+
+// bufferBody reads request bodies of up to maxBytes into memory, so they can
+// be sent again on retry. Larger bodies are streamed through as usual, and
+// aren't retried.
+func bufferBody(maxBytes int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody || r.ContentLength > maxBytes {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+			if err != nil {
+				bodyReadError(w, err)
+				return
+			}
+			if int64(len(body)) > maxBytes {
+				// put back what was read ahead of the rest.
+				r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body.Close()
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+			// a chunked upload now has a known length, sent as Content-Length on every attempt.
+			r.ContentLength = int64(len(body))
+			r.TransferEncoding = nil
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), bufferedBodyKey{}, true)))
+		})
+	}
+}
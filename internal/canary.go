@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+)
+
+// ProxyUpstreamHeader tells clients which upstream served their request,
+// "primary" or "canary", when a canary is configured.
+const ProxyUpstreamHeader = "X-Proxy-Upstream"
+
+type upstreamNameKey struct{}
+
+func withUpstreamName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, upstreamNameKey{}, name)
+}
+
+func upstreamNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(upstreamNameKey{}).(string)
+	return name
+}
+
+// routeCanary decides whether req goes to the canary: it does if it carries
+// the canary header, or else with probability CanaryFraction. It's decided
+// once per request in Rewrite, so retries go to the same upstream. The header
+// must be sent, even when it's expected to be empty.
+func routeCanary(cfg *Config, req *http.Request) bool {
+	if cfg.CanaryHeader != "" && len(req.Header.Values(cfg.CanaryHeader)) > 0 && req.Header.Get(cfg.CanaryHeader) == cfg.CanaryHeaderValue {
+		return true
+	}
+	return rand.Float64() < cfg.CanaryFraction
+}
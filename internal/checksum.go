@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digestAlgorithms maps RFC 3230 Digest algorithm names to hash constructors.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// maxChecksumBytes caps the bodies validateChecksum buffers to hash, so a
+// digest header can't be used to make the proxy hold an unbounded body in
+// memory. MaxRequestBytes, if lower, cuts them off first.
+const maxChecksumBytes = 32 << 20
+
+// validateChecksum rejects requests whose body doesn't match a Content-MD5
+// or Digest header with 400. The body is buffered in memory to be hashed,
+// then rewound so it can still be forwarded upstream. Bodies over
+// maxChecksumBytes are rejected with 413.
+// Requests without either header pass through untouched.
+func validateChecksum(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := expectedDigests(r.Header)
+		if len(expected) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > maxChecksumBytes {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("the request body exceeds %d bytes", int64(maxChecksumBytes)))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxChecksumBytes))
+		r.Body.Close()
+		if err != nil {
+			bodyReadError(w, err)
+			return
+		}
+
+		for algorithm, want := range expected {
+			h := digestAlgorithms[algorithm]()
+			h.Write(body)
+			if base64.StdEncoding.EncodeToString(h.Sum(nil)) != want {
+				writeJSONError(w, http.StatusBadRequest, "checksum_mismatch", "request body does not match "+algorithm+" digest")
+				return
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expectedDigests collects base64 digests by algorithm from Content-MD5 and
+// Digest headers. Algorithms we don't support are ignored.
+func expectedDigests(h http.Header) map[string]string {
+	expected := map[string]string{}
+	if md5sum := h.Get("Content-MD5"); md5sum != "" {
+		expected["md5"] = md5sum
+	}
+	for _, value := range h.Values("Digest") {
+		for _, part := range strings.Split(value, ",") {
+			algorithm, digest, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok {
+				continue
+			}
+			algorithm = strings.ToLower(algorithm)
+			if _, supported := digestAlgorithms[algorithm]; supported {
+				expected[algorithm] = digest
+			}
+		}
+	}
+	return expected
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrSet is a precompiled list of networks for fast client IP matching.
+type cidrSet []*net.IPNet
+
+// parseCIDRs compiles cidrs into a cidrSet. Bare IPs are treated as
+// single-host networks.
+func parseCIDRs(cidrs []string) (cidrSet, error) {
+	var set cidrSet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", cidr, err)
+		}
+		set = append(set, network)
+	}
+	return set, nil
+}
+
+// contains reports whether ip falls within any network in the set.
+func (s cidrSet) contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range s {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
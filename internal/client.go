@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// clientIP returns the address of the client that sent req: the one found
+// by resolveClient behind trusted proxies, or else its peer's.
+func clientIP(req *http.Request) string {
+	if client := clientFromContext(req.Context()); client != "" {
+		return client
+	}
+	return peerIP(req)
+}
+
+// peerIP returns the address of whatever connected to us to send req, which
+// may be a proxy in front of us.
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// realClientIP returns the address of the client behind any trusted proxies.
+// That's the peer, unless it's trusted, in which case it's the rightmost
+// X-Forwarded-For entry that isn't: entries further left came from the client
+// itself, so could be anything.
+func realClientIP(req *http.Request, trusted cidrSet) string {
+	peer := peerIP(req)
+	if !trusted.contains(peer) {
+		return peer
+	}
+	addrs := forwardedFor(req.Header)
+	if i := clientIndex(addrs, trusted); i >= 0 {
+		return addrs[i]
+	}
+	return peer
+}
+
+// clientIndex returns the index of the client in a trusted proxy's
+// X-Forwarded-For chain: the rightmost untrusted entry, or the leftmost if
+// every hop is trusted. It's -1 for an empty chain.
+func clientIndex(addrs []string, trusted cidrSet) int {
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if !trusted.contains(addrs[i]) {
+			return i
+		}
+	}
+	if len(addrs) > 0 {
+		return 0
+	}
+	return -1
+}
+
+// resolveClient records the real client behind trusted proxies on each
+// request's context, for clientIP to find. It belongs outside all other
+// middleware, so they all agree on who the client is.
+func resolveClient(trusted cidrSet) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withClient(r.Context(), realClientIP(r, trusted))))
+		})
+	}
+}
+
+type clientKey struct{}
+
+// withClient records the originating client on a request's context. It's
+// carried over to the outbound request, since the transport only sees that.
+func withClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// concurrencyLimiter caps how many requests are proxied at once, so a burst
+// queues briefly at the proxy instead of piling onto the upstream. Each
+// client may have up to perClient requests waiting in the queue, if set.
+type concurrencyLimiter struct {
+	slots     chan struct{}
+	wait      time.Duration
+	perClient int
+	inFlight  prometheus.Gauge
+
+	mu     sync.Mutex
+	queued map[string]int
+}
+
+var (
+	errOverloaded      = errors.New("no concurrency slot free")
+	errClientQueueFull = errors.New("client's queue is full")
+)
+
+func newConcurrencyLimiter(n int, wait time.Duration, perClient int) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:     make(chan struct{}, n),
+		wait:      wait,
+		perClient: perClient,
+		queued:    map[string]int{},
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cohere_proxy_in_flight_requests",
+			Help: "Requests currently holding one of the proxy's concurrency slots.",
+		}),
+	}
+}
+
+// acquire takes a slot, waiting up to l.wait for one to free up. It gives up
+// early if the client goes away in the meantime, or straight away if the
+// client already has as many requests waiting as it may.
+func (l *concurrencyLimiter) acquire(r *http.Request) error {
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Inc()
+		return nil
+	default:
+	}
+	if l.wait <= 0 {
+		return errOverloaded
+	}
+
+	client := clientIP(r)
+	if !l.enqueue(client) {
+		return errClientQueueFull
+	}
+	defer l.dequeue(client)
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Inc()
+		return nil
+	case <-timer.C:
+		return errOverloaded
+	case <-r.Context().Done():
+		return errOverloaded
+	}
+}
+
+// enqueue counts a request from client into the queue, unless it already
+// has perClient requests there.
+func (l *concurrencyLimiter) enqueue(client string) bool {
+	if l.perClient <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.queued[client] >= l.perClient {
+		return false
+	}
+	l.queued[client]++
+	return true
+}
+
+func (l *concurrencyLimiter) dequeue(client string) {
+	if l.perClient <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// only clients with requests waiting are kept, so the map stays bounded.
+	if l.queued[client]--; l.queued[client] <= 0 {
+		delete(l.queued, client)
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	l.inFlight.Dec()
+	<-l.slots
+}
+
+// limit sheds requests that can't get a slot with a 503, or a 429 if their
+// client has too many waiting already. The slot is held until the handler
+// returns, which the reverse proxy does as soon as the client disconnects,
+// even mid-stream.
+func (l *concurrencyLimiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := l.acquire(r); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(l.wait.Seconds())))))
+			if err == errClientQueueFull {
+				writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "too many of your requests are queued, try again shortly")
+				return
+			}
+			writeJSONError(w, http.StatusServiceUnavailable, "overloaded", "too many requests in flight, try again shortly")
+			return
+		}
+		defer l.release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"log"
+	"net/http"
+)
+
+// normalizeContentType keeps only the first of multiple upstream Content-Type
+// values. Clients disagree on which one wins, and some reject the response.
+func normalizeContentType(resp *http.Response, logger *log.Logger) {
+	types := resp.Header.Values("Content-Type")
+	if len(types) < 2 {
+		return
+	}
+	logger.Printf("normalized %d Content-Type values from upstream for %s %s to %q", len(types), resp.Request.Method, resp.Request.URL, types[0])
+	resp.Header.Set("Content-Type", types[0])
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy has the proxy answer CORS for browser clients on a set of paths,
+// rather than forwarding OPTIONS requests to the upstream.
+type CORSPolicy struct {
+	// PathPrefix selects the requests the policy applies to by their incoming path.
+	PathPrefix string
+	// AllowedOrigins lists the origins allowed to call these paths; "*" allows any.
+	AllowedOrigins []string
+	// AllowedMethods are sent in answer to preflights. Defaults to GET and POST.
+	AllowedMethods []string
+	// AllowedHeaders are sent in answer to preflights. Defaults to whatever
+	// headers the preflight asks for.
+	AllowedHeaders []string
+	// MaxAge, if set, lets browsers cache the preflight answer.
+	MaxAge time.Duration
+}
+
+// matchCORS returns the policy with the longest prefix matching path.
+func matchCORS(policies []CORSPolicy, path string) *CORSPolicy {
+	var match *CORSPolicy
+	for i, p := range policies {
+		if strings.HasPrefix(path, p.PathPrefix) && (match == nil || len(p.PathPrefix) > len(match.PathPrefix)) {
+			match = &policies[i]
+		}
+	}
+	return match
+}
+
+// allowOrigin sets Access-Control-Allow-Origin on h if origin is allowed,
+// reporting whether it was.
+func (p *CORSPolicy) allowOrigin(h http.Header, origin string) bool {
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	switch {
+	case slices.Contains(p.AllowedOrigins, "*"):
+		h.Set("Access-Control-Allow-Origin", "*")
+	case slices.Contains(p.AllowedOrigins, origin):
+		h.Set("Access-Control-Allow-Origin", origin)
+	default:
+		return false
+	}
+	return true
+}
+
+// cors answers OPTIONS requests on paths with a CORS policy itself,
+// including preflights from allowed origins, and marks other requests there
+// for corsHeaders. OPTIONS requests elsewhere are forwarded to the upstream
+// like any other.
+func cors(policies []CORSPolicy) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := matchCORS(policies, r.URL.Path)
+			if p == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Method != http.MethodOptions {
+				next.ServeHTTP(w, r.WithContext(withCORS(r.Context(), p)))
+				return
+			}
+
+			h := w.Header()
+			if p.allowOrigin(h, r.Header.Get("Origin")) && r.Header.Get("Access-Control-Request-Method") != "" {
+				methods := p.AllowedMethods
+				if len(methods) == 0 {
+					methods = []string{http.MethodGet, http.MethodPost}
+				}
+				h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+				if len(p.AllowedHeaders) > 0 {
+					h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+				} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					h.Set("Access-Control-Allow-Headers", requested)
+				}
+				if p.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+				}
+			}
+			h.Set("Allow", "OPTIONS, GET, HEAD, POST")
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+type corsKey struct{}
+
+// withCORS remembers the CORS policy a request matched, so its response can
+// carry the matching headers.
+func withCORS(ctx context.Context, p *CORSPolicy) context.Context {
+	return context.WithValue(ctx, corsKey{}, p)
+}
+
+// corsHeaders replaces any CORS headers from the upstream with the proxy's
+// own, for requests on paths with a CORS policy.
+func corsHeaders(resp *http.Response) {
+	p, _ := resp.Request.Context().Value(corsKey{}).(*CORSPolicy)
+	if p == nil {
+		return
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			resp.Header.Del(name)
+		}
+	}
+	p.allowOrigin(resp.Header, resp.Request.Header.Get("Origin"))
+}
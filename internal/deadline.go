@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHintHeader tells the upstream how many milliseconds remain before
+// the proxy gives up on a request, so it can shed work it can't finish in time.
+const DeadlineHintHeader = "X-Request-Timeout-Ms"
+
+// setDeadlineHint sets DeadlineHintHeader on out from its context deadline,
+// replacing any value from the client. Without a deadline, it's removed.
+func setDeadlineHint(out *http.Request) {
+	deadline, ok := out.Context().Deadline()
+	if !ok {
+		out.Header.Del(DeadlineHintHeader)
+		return
+	}
+	out.Header.Set(DeadlineHintHeader, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 0), 10))
+}
+
+// deadlineGrace keeps the connection writable briefly past the request
+// deadline, so a 504 can still reach the client.
+const deadlineGrace = time.Second
+
+// requestDeadline bounds the whole request lifecycle: reading the body,
+// waiting on the upstream, and writing the response. Upstream stalls are cut
+// off through the request context and answered with a 504 by the proxy's
+// error handler; client stalls hit the connection deadlines.
+func requestDeadline(d time.Duration, cfg *Config) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline := time.Now().Add(d)
+
+			rc := http.NewResponseController(w)
+			// the read deadline only covers the body. once it's read, the server
+			// watches the connection for the client going away, and a deadline
+			// firing there would cancel every later request on the connection.
+			if r.Body != nil && r.Body != http.NoBody {
+				if err := rc.SetReadDeadline(deadline); err != nil {
+					cfg.Logger.Printf("failed to set request read deadline: %s", err)
+				}
+				r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+			}
+			if err := rc.SetWriteDeadline(deadline.Add(deadlineGrace)); err != nil {
+				cfg.Logger.Printf("failed to set request write deadline: %s", err)
+			}
+
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// deadlineBody clears the connection read deadline once the body is fully read.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
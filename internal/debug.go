@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// DebugPathPrefix is where Server exposes pprof and expvar when enabled with
+// WithDebugEndpoints. Paths under it are never proxied upstream.
+const DebugPathPrefix = "/debug/"
+
+// debugHandler serves net/http/pprof under /debug/pprof/ and expvar at
+// /debug/vars.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serveDebug answers requests under DebugPathPrefix with debug, or with a 404
+// if debug is nil because it's served elsewhere. Either way they're never
+// forwarded to next.
+func serveDebug(next, debug http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, DebugPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if debug == nil {
+			http.NotFound(w, r)
+			return
+		}
+		debug.ServeHTTP(w, r)
+	})
+}
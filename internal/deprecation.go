@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Deprecation marks a legacy route whose responses should nudge clients to migrate.
+type Deprecation struct {
+	// PathPrefix selects the deprecated requests by their incoming path.
+	PathPrefix string
+	// Since is when the route was deprecated, sent as the Deprecation header (RFC 9745).
+	Since time.Time
+	// Sunset, if set, is when the route will stop working, sent as the Sunset header (RFC 8594).
+	Sunset time.Time
+	// Link, if set, points clients at migration docs.
+	Link string
+}
+
+// header sets the deprecation headers on h.
+func (d *Deprecation) header(h http.Header) {
+	h.Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+	if !d.Sunset.IsZero() {
+		h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, d.Link))
+	}
+}
+
+// matchDeprecation returns the deprecation with the longest prefix matching path.
+func matchDeprecation(deprecations []Deprecation, path string) *Deprecation {
+	var match *Deprecation
+	for i, d := range deprecations {
+		if strings.HasPrefix(path, d.PathPrefix) && (match == nil || len(d.PathPrefix) > len(match.PathPrefix)) {
+			match = &deprecations[i]
+		}
+	}
+	return match
+}
+
+type deprecationKey struct{}
+
+// withDeprecation remembers which deprecated route a request matched, since
+// ModifyResponse only sees the rewritten upstream path.
+func withDeprecation(ctx context.Context, d *Deprecation) context.Context {
+	return context.WithValue(ctx, deprecationKey{}, d)
+}
+
+func deprecationFromContext(ctx context.Context) *Deprecation {
+	d, _ := ctx.Value(deprecationKey{}).(*Deprecation)
+	return d
+}
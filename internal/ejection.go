@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// setEjection makes threshold consecutive failures eject a target from
+// rotation for d.
+func (b *AdaptiveBalancer) setEjection(threshold int, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.ejectFor = d
+}
+
+func (t *adaptiveTarget) ejected(now time.Time) bool {
+	return now.Before(t.ejectedUntil)
+}
+
+// Ejected lists the targets currently out of rotation after failing
+// repeatedly. See WithEjectionThreshold.
+func (b *AdaptiveBalancer) Ejected() []*url.URL {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ejected []*url.URL
+	now := time.Now()
+	for _, t := range b.targets {
+		if t.ejected(now) {
+			ejected = append(ejected, t.url)
+		}
+	}
+	return ejected
+}
+
+var ejectedDesc = prometheus.NewDesc(
+	"cohere_proxy_upstream_ejected",
+	"Whether the upstream target is ejected from rotation after repeated failures.",
+	[]string{"target"}, nil,
+)
+
+// ejectionCollector exports each balancer target's ejected state as of the scrape.
+type ejectionCollector struct {
+	balancer *AdaptiveBalancer
+}
+
+func (c *ejectionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ejectedDesc
+}
+
+func (c *ejectionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.balancer.mu.Lock()
+	defer c.balancer.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range c.balancer.targets {
+		v := 0.0
+		if t.ejected(now) {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(ejectedDesc, prometheus.GaugeValue, v, t.url.String())
+	}
+}
@@ -0,0 +1,15 @@
+package internal
+
+import "net/http"
+
+// emptyAsNoContent rewrites a 200 with an empty body to 204 No Content,
+// for clients that treat an empty 200 as a malformed response.
+// Responses to HEAD are left alone, since their bodies are always empty.
+func emptyAsNoContent(resp *http.Response) {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 0 || resp.Request.Method == http.MethodHead {
+		return
+	}
+	resp.StatusCode = http.StatusNoContent
+	resp.Status = "204 No Content"
+	resp.Header.Del("Content-Length")
+}
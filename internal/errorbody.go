@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// logErrorBody logs up to limit bytes of an upstream error response body
+// (status >= 400), decompressing it first if the upstream gzip'd it.
+// The body is restored so the client still receives it unchanged.
+func logErrorBody(resp *http.Response, limit int64, logger *log.Logger) {
+	if resp.StatusCode < http.StatusBadRequest || resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+
+	peeked, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(peeked), resp.Body), resp.Body}
+	if err != nil {
+		logger.Printf("failed to read upstream error body for %s %s: %s", resp.Request.Method, resp.Request.URL, err)
+		return
+	}
+
+	body := peeked
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if zr, err := gzip.NewReader(bytes.NewReader(peeked)); err == nil {
+			// a truncated body still decompresses up to the cut, which is good enough for a
+			// log line. a few compressed bytes can expand a long way, so limit that too.
+			body, _ = io.ReadAll(io.LimitReader(zr, limit))
+		}
+	}
+
+	logger.Printf("upstream returned %d for %s %s: %s", resp.StatusCode, resp.Request.Method, resp.Request.URL, body)
+}
+
+// readCloser joins a reader with the closer of the body it was derived from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
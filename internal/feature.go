@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+)
+
+// FeatureHeader lets clients opt into experimental proxy behavior, as a
+// comma-separated list of feature names.
+const FeatureHeader = "X-Feature"
+
+// Feature is an experimental behavior clients can opt into per request.
+type Feature struct {
+	Name       string
+	Middleware func(http.Handler) http.Handler
+}
+
+// featureFlags applies the features a request asks for via X-Feature.
+// Only registered features can be activated; unknown names are ignored,
+// so the registry doubles as the allowlist. The header isn't forwarded.
+func featureFlags(features []Feature) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested := map[string]bool{}
+			for _, v := range r.Header.Values(FeatureHeader) {
+				for _, name := range strings.Split(v, ",") {
+					requested[strings.ToLower(strings.TrimSpace(name))] = true
+				}
+			}
+			r.Header.Del(FeatureHeader)
+
+			h := next
+			// wrap in reverse so features apply in registration order.
+			for i := len(features) - 1; i >= 0; i-- {
+				if requested[strings.ToLower(features[i].Name)] {
+					h = features[i].Middleware(h)
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// firstByteTransport fails requests whose upstream sends headers promptly but
+// then stalls before the first byte of the body, e.g. a streaming completion
+// that never starts. Nothing has been written to the client yet at that
+// point, so the proxy's error handler can still answer with a 504.
+type firstByteTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *firstByteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !hasBody(resp) {
+		return resp, err
+	}
+
+	br := bufio.NewReader(resp.Body)
+	peeked := make(chan struct{})
+	go func() {
+		// errors, including EOF for an empty body, surface on the first Read.
+		br.Peek(1)
+		close(peeked)
+	}()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case <-peeked:
+		resp.Body = readCloser{Reader: br, Closer: resp.Body}
+		return resp, nil
+	case <-timer.C:
+		// closing the body unblocks the pending read and drops the connection.
+		resp.Body.Close()
+		<-peeked
+		return nil, fmt.Errorf("no response body from upstream within %s: %w", t.timeout, os.ErrDeadlineExceeded)
+	case <-req.Context().Done():
+		resp.Body.Close()
+		<-peeked
+		return nil, req.Context().Err()
+	}
+}
+
+// hasBody reports whether resp may carry a body worth waiting for.
+// Upgraded connections are excluded, since their body is the raw connection.
+func hasBody(resp *http.Response) bool {
+	switch {
+	case resp.Request.Method == http.MethodHead, resp.ContentLength == 0:
+		return false
+	case resp.StatusCode == http.StatusSwitchingProtocols, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return resp.Body != nil && resp.Body != http.NoBody
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+)
+
+// forwardedFor returns the addresses in h's X-Forwarded-For, client first.
+// Multiple header lines are read as one comma-separated list, as RFC 9110
+// 5.3 has it, and empty entries are skipped.
+func forwardedFor(h http.Header) []string {
+	var addrs []string
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(line, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// keepForwardedFor carries a trusted proxy's X-Forwarded-For chain over to
+// the outbound request as a single header, for SetXForwarded to append to.
+// The chain starts at the real client; whatever it claimed before that is
+// dropped, along with chains from anyone but trusted proxies, as ReverseProxy
+// already has.
+func keepForwardedFor(r *http.Request, out *http.Request, trusted cidrSet) {
+	if !trusted.contains(peerIP(r)) {
+		return
+	}
+	addrs := forwardedFor(r.Header)
+	if i := clientIndex(addrs, trusted); i >= 0 {
+		out.Header.Set("X-Forwarded-For", strings.Join(addrs[i:], ", "))
+	}
+}
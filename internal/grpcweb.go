@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// grpc-web marks the trailer frame at the end of the body with the high bit set.
+const grpcWebTrailerFlag = 0x80
+
+// isGRPCWeb reports whether req uses the binary gRPC-Web protocol.
+// The base64 "grpc-web-text" variant is not translated.
+func isGRPCWeb(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	return ct == "application/grpc-web" || strings.HasPrefix(ct, "application/grpc-web+")
+}
+
+func isGRPC(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+")
+}
+
+// grpcWeb translates browser gRPC-Web requests to native gRPC for the upstream.
+//
+// Message framing is identical between the two, so request bodies pass through
+// as-is. The differences are the content type and how trailers travel: gRPC
+// sends them as HTTP/2 trailers, while gRPC-Web appends them to the body as a
+// final length-prefixed frame, since browsers can't read trailers.
+func grpcWeb(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGRPCWeb(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Header.Set("Content-Type", strings.Replace(r.Header.Get("Content-Type"), "application/grpc-web", "application/grpc", 1))
+		// gRPC servers require this; ReverseProxy preserves it across the hop.
+		r.Header.Set("Te", "trailers")
+		r.Header.Del("X-Grpc-Web")
+
+		gw := &grpcWebResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+		gw.writeTrailers()
+	})
+}
+
+// grpcWebResponseWriter rewrites a gRPC response into gRPC-Web on the fly.
+type grpcWebResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	announced   []string
+}
+
+func (w *grpcWebResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	// trailers are moved into the body, so they mustn't be announced as real trailers.
+	for _, v := range h.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				w.announced = append(w.announced, http.CanonicalHeaderKey(k))
+			}
+		}
+	}
+	h.Del("Trailer")
+	// the trailer frame makes the body longer than upstream declared.
+	h.Del("Content-Length")
+
+	if ct := h.Get("Content-Type"); strings.HasPrefix(ct, "application/grpc") {
+		h.Set("Content-Type", strings.Replace(ct, "application/grpc", "application/grpc-web", 1))
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *grpcWebResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *grpcWebResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeTrailers emits any trailers set by the proxy as a gRPC-Web trailer frame.
+// Trailers-only responses carry grpc-status in the headers and need no frame.
+func (w *grpcWebResponseWriter) writeTrailers() {
+	if !w.wroteHeader {
+		return
+	}
+
+	h := w.Header()
+	trailers := http.Header{}
+	for _, k := range w.announced {
+		if vv, ok := h[k]; ok {
+			trailers[k] = vv
+		}
+	}
+	for k, vv := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vv
+			delete(h, k)
+		}
+	}
+	if len(trailers) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(trailers))
+	for k := range trailers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var block bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailers[k] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.Bytes()...)
+
+	w.ResponseWriter.Write(frame)
+}
+
+// grpcTransport sends gRPC requests to plaintext upstreams over HTTP/2 without
+// TLS (h2c), since gRPC requires HTTP/2 and http.Transport only negotiates it via TLS.
+type grpcTransport struct {
+	next http.RoundTripper
+	h2c  *http2.Transport
+}
+
+func newGRPCTransport(next http.RoundTripper) *grpcTransport {
+	return &grpcTransport{
+		next: next,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isGRPC(req) && req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.next.RoundTrip(req)
+}
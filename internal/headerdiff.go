@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// sensitiveHeaders have their values redacted from header diffs.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	UpstreamTokenHeader:   true,
+}
+
+// diffHeaders describes how after differs from before, one entry per header
+// in name order: "+Name: value" if added, "-Name" if removed and
+// "~Name: old -> new" if modified.
+func diffHeaders(before, after http.Header) []string {
+	names := map[string]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var diff []string
+	for _, name := range sorted {
+		old, had := before[name]
+		now, has := after[name]
+		switch {
+		case !had:
+			diff = append(diff, fmt.Sprintf("+%s: %s", name, headerValue(name, now)))
+		case !has:
+			diff = append(diff, "-"+name)
+		case strings.Join(old, "\x00") != strings.Join(now, "\x00"):
+			diff = append(diff, fmt.Sprintf("~%s: %s -> %s", name, headerValue(name, old), headerValue(name, now)))
+		}
+	}
+	return diff
+}
+
+func headerValue(name string, values []string) string {
+	if sensitiveHeaders[name] {
+		return "[redacted]"
+	}
+	return strings.Join(values, ", ")
+}
+
+// logHeaderDiff logs the changes the proxy made to the headers of one side
+// of req's exchange, if any.
+func logHeaderDiff(logger *log.Logger, side string, req *http.Request, before, after http.Header) {
+	if diff := diffHeaders(before, after); len(diff) > 0 {
+		logger.Printf("%s headers for %s %s: %s", side, req.Method, req.URL.Path, strings.Join(diff, ", "))
+	}
+}
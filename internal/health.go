@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// healthProbe is one upstream request made by the health check.
+type healthProbe struct {
+	url *url.URL
+	// target is the balancer target probed, if any.
+	target *url.URL
+	// status is the status a healthy upstream answers with; zero accepts any
+	// status short of a server error.
+	status int
+}
+
+// healthProbes lists what to probe: every target of an AdaptiveBalancer,
+// each with its own path and status if configured, or else target alone.
+func healthProbes(target *url.URL, cfg *Config) []healthProbe {
+	probe := func(u *url.URL, path string, status int) healthProbe {
+		if path == "" {
+			path = cfg.HealthCheckPath
+		}
+		if status == 0 {
+			status = cfg.HealthyStatus
+		}
+		return healthProbe{url: u.ResolveReference(&url.URL{Path: path}), target: u, status: status}
+	}
+
+	b, ok := cfg.Balancer.(*AdaptiveBalancer)
+	if !ok {
+		return []healthProbe{probe(target, "", 0)}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probes := make([]healthProbe, 0, len(b.targets))
+	for _, t := range b.targets {
+		probes = append(probes, probe(t.url, t.healthPath, t.healthyStatus))
+	}
+	return probes
+}
+
+// healthCheck reports whether the upstream is reachable, for liveness and
+// readiness probes. It sends a HEAD to each upstream's health path and
+// answers 200 if any of them is healthy, 503 otherwise. Balancer targets
+// currently ejected for failing requests count as unhealthy without a probe.
+func healthCheck(target *url.URL, cfg *Config) http.Handler {
+	client := &http.Client{Transport: cfg.Transport, Timeout: cfg.HealthCheckTimeout}
+	probes := healthProbes(target, cfg)
+	b, _ := cfg.Balancer.(*AdaptiveBalancer)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ejected []*url.URL
+		if b != nil {
+			ejected = b.Ejected()
+		}
+		for _, p := range probes {
+			if slices.Contains(ejected, p.target) {
+				cfg.Logger.Printf("health check skipped %s: ejected after repeated failures", p.target)
+				continue
+			}
+			err := probeUpstream(r.Context(), client, p)
+			if err == nil {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			cfg.Logger.Printf("health check failed: %s", err)
+		}
+		http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+	})
+}
+
+func probeUpstream(ctx context.Context, client *http.Client, p healthProbe) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if (p.status == 0 && resp.StatusCode >= 500) || (p.status != 0 && resp.StatusCode != p.status) {
+		return fmt.Errorf("%s returned %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+// serveLocal answers requests for the given paths itself, forwarding
+// everything else to next. Local paths are never proxied upstream.
+func serveLocal(next http.Handler, routes map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := routes[r.URL.Path]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
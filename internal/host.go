@@ -0,0 +1,20 @@
+package internal
+
+import "net/http"
+
+// missingHost handles HTTP/1.0 requests that arrive without a Host header.
+// HTTP/1.1 requires Host, and net/http already rejects those without one.
+func missingHost(cfg *Config) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Host == "" {
+				if cfg.RejectMissingHost {
+					http.Error(w, "missing required Host header", http.StatusBadRequest)
+					return
+				}
+				r.Host = cfg.DefaultHost
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentReplayedHeader marks a response replayed from the idempotency store.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotentBody is the largest response body kept for replay. Larger
+// responses, e.g. long streams, are passed through without being stored.
+const maxIdempotentBody = 1 << 20
+
+// StoredResponse is a response kept for replay to requests repeating an
+// Idempotency-Key.
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore keeps responses by idempotency key. Implementations must
+// be safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the response stored for key, if it hasn't expired.
+	Get(key string) (*StoredResponse, bool)
+	// Put stores resp for key until ttl has passed.
+	Put(key string, resp *StoredResponse, ttl time.Duration)
+}
+
+// memoryIdempotencyStore is an IdempotencyStore in process memory. Expired
+// entries are swept out opportunistically as new ones are stored.
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]storedEntry
+	lastSweep time.Time
+}
+
+type storedEntry struct {
+	resp    *StoredResponse
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an IdempotencyStore held in memory, for a
+// single proxy instance.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{entries: map[string]storedEntry{}}
+}
+
+func (s *memoryIdempotencyStore) Get(key string) (*StoredResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+func (s *memoryIdempotencyStore) Put(key string, resp *StoredResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if !now.Before(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.entries[key] = storedEntry{resp: resp, expires: now.Add(ttl)}
+}
+
+// idempotency replays the stored response to requests repeating an
+// Idempotency-Key within ttl, without sending them upstream. Keys are scoped
+// to the client, method and path, so one client can't replay another's
+// response. A repeat arriving while the first request is still in flight
+// gets a 409. Server errors aren't stored, so they can be retried.
+func idempotency(store IdempotencyStore, ttl time.Duration) middleware {
+	var mu sync.Mutex
+	inFlight := map[string]bool{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idemKey := r.Header.Get(IdempotencyKeyHeader)
+			if idemKey == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := requestClientKey(r) + " " + r.Method + " " + r.URL.Path + " " + idemKey
+
+			if stored, ok := store.Get(key); ok {
+				h := w.Header()
+				for name, values := range stored.Header {
+					h[name] = values
+				}
+				h.Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			mu.Lock()
+			if inFlight[key] {
+				mu.Unlock()
+				writeJSONError(w, http.StatusConflict, "idempotency_conflict", "a request with this Idempotency-Key is already in progress")
+				return
+			}
+			inFlight[key] = true
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				delete(inFlight, key)
+				mu.Unlock()
+			}()
+
+			rec := &recordingWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+			next.ServeHTTP(rec, r)
+			if status := rec.code(); status < 500 && !rec.overflow {
+				store.Put(key, &StoredResponse{Status: status, Header: w.Header().Clone(), Body: rec.body.Bytes()}, ttl)
+			}
+		})
+	}
+}
+
+// recordingWriter keeps a copy of the response body, up to maxIdempotentBody.
+type recordingWriter struct {
+	statusRecorder
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusRecorder.Write(b)
+	if !w.overflow {
+		if w.body.Len()+n > maxIdempotentBody {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,46 @@
+package internal
+
+import "net/http"
+
+// filterClients rejects requests with a 403 unless their client, resolved
+// behind any trusted proxies, is allowed: it mustn't be in DeniedCIDRs, and
+// must be in AllowedCIDRs if there are any. Denial wins where both match.
+func filterClients(cfg *Config) middleware {
+	allowed, allowErr := parseCIDRs(cfg.AllowedCIDRs)
+	denied, denyErr := parseCIDRs(cfg.DeniedCIDRs)
+	// failing open would let in everyone the lists were meant to keep out.
+	closed := allowErr != nil || denyErr != nil
+	if allowErr != nil {
+		cfg.Logger.Printf("rejecting all requests: invalid allowed CIDRs: %s", allowErr)
+	}
+	if denyErr != nil {
+		cfg.Logger.Printf("rejecting all requests: invalid denied CIDRs: %s", denyErr)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := clientIP(r)
+			if closed || denied.contains(client) || (len(cfg.AllowedCIDRs) > 0 && !allowed.contains(client)) {
+				writeJSONError(w, http.StatusForbidden, "forbidden", "requests from this address are not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// restrictClients applies filterClients to all of h, resolving clients behind
+// trusted proxies first, if any CIDRs are configured. NewServer uses it so its
+// own routes, such as the debug and metrics endpoints, are covered as well as
+// the proxy.
+func restrictClients(h http.Handler, cfg *Config) http.Handler {
+	if len(cfg.AllowedCIDRs) == 0 && len(cfg.DeniedCIDRs) == 0 {
+		return h
+	}
+	h = filterClients(cfg)(h)
+	// invalid entries are reported by wrap, or Validate.
+	if trusted, _ := parseCIDRs(cfg.TrustedProxies); len(trusted) > 0 {
+		h = resolveClient(trusted)(h)
+	}
+	return h
+}
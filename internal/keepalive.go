@@ -0,0 +1,15 @@
+package internal
+
+import "net/http"
+
+// closeHTTP10 downgrades HTTP/1.0 keep-alive connections to one request per
+// connection. net/http otherwise honors "Connection: keep-alive" from 1.0 clients,
+// which some legacy clients request but then mishandle.
+func closeHTTP10(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.ProtoAtLeast(1, 1) {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
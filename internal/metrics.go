@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where Server exposes Prometheus metrics when enabled.
+// It's served locally and never proxied.
+const MetricsPath = "/metrics"
+
+// DefaultBodySizeBuckets are the request and response body size histogram
+// buckets, in bytes: 64B to 16MiB, by powers of 4.
+var DefaultBodySizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+type proxyMetrics struct {
+	requests      *prometheus.CounterVec
+	requestBytes  *prometheus.HistogramVec
+	responseBytes *prometheus.HistogramVec
+}
+
+// newProxyMetrics registers the proxy's collectors with reg. Handlers sharing
+// a registry share collectors, rather than failing to register twice. Body
+// sizes are bucketed by sizeBuckets, or DefaultBodySizeBuckets if empty.
+func newProxyMetrics(reg prometheus.Registerer, sizeBuckets []float64) (*proxyMetrics, error) {
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = DefaultBodySizeBuckets
+	}
+	// the histograms would panic on these.
+	if err := checkBuckets(sizeBuckets); err != nil {
+		return nil, fmt.Errorf("invalid body size buckets: %s", err)
+	}
+
+	m := &proxyMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cohere_proxy_requests_total",
+			Help: "Requests handled by the proxy, by method and response status.",
+		}, []string{"method", "status"}),
+		requestBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cohere_proxy_request_body_bytes",
+			Help:    "Size of request bodies read from clients, by method.",
+			Buckets: sizeBuckets,
+		}, []string{"method"}),
+		responseBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cohere_proxy_response_body_bytes",
+			Help:    "Size of response bodies written to clients, by method.",
+			Buckets: sizeBuckets,
+		}, []string{"method"}),
+	}
+
+	var err error
+	m.requests, err = register(reg, m.requests)
+	if err != nil {
+		return nil, err
+	}
+	m.requestBytes, err = register(reg, m.requestBytes)
+	if err != nil {
+		return nil, err
+	}
+	m.responseBytes, err = register(reg, m.responseBytes)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkBuckets reports an error unless buckets are strictly increasing.
+func checkBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("must be strictly increasing, got %v after %v", buckets[i], buckets[i-1])
+		}
+	}
+	return nil
+}
+
+func register[C prometheus.Collector](reg prometheus.Registerer, c C) (C, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// newBodyErrorCounter registers the counter of upstream response bodies that
+// failed mid-copy, by reason: "short" when the upstream closed before its
+// declared Content-Length, "failed" for other connection failures.
+func newBodyErrorCounter(reg prometheus.Registerer) (*prometheus.CounterVec, error) {
+	return register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cohere_proxy_upstream_body_errors_total",
+		Help: "Upstream response bodies that ended early, by reason.",
+	}, []string{"reason"}))
+}
+
+// newUpstreamLatency registers the histogram of upstream round trips.
+func newUpstreamLatency(reg prometheus.Registerer) (*prometheus.HistogramVec, error) {
+	return register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cohere_proxy_upstream_latency_seconds",
+		Help:    "Time from sending a request upstream to receiving its response headers, per attempt, by method and response status class.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"method", "status_class"}))
+}
+
+// latencyTransport observes each upstream round trip, retries included, up
+// to the response headers. Time spent in the proxy itself, queueing or
+// copying bodies, isn't counted. Round trips are split by status class, e.g.
+// "5xx", to tell fast failures from timeouts, or "error" if there was no
+// response at all.
+type latencyTransport struct {
+	next    http.RoundTripper
+	latency *prometheus.HistogramVec
+}
+
+func (t *latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	class := "error"
+	if err == nil {
+		class = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+	t.latency.WithLabelValues(req.Method, class).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// instrument records every request's method and status, and the sizes of
+// its request and response bodies. The request body is counted as it's
+// read, so bodies rejected partway are counted up to where they were cut off.
+func (m *proxyMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		m.requests.WithLabelValues(r.Method, strconv.Itoa(rec.code())).Inc()
+		m.requestBytes.WithLabelValues(r.Method).Observe(float64(body.n.Load()))
+		m.responseBytes.WithLabelValues(r.Method).Observe(float64(rec.written))
+	})
+}
+
+// countingBody counts the bytes read through it.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// metricsHandler serves the metrics gathered by reg.
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewHandler returns the reverse proxy for target wrapped in all middleware
+// enabled by opts. Use it to embed the proxy in your own http.Server;
+// NewServer uses it internally.
+func NewHandler(target *url.URL, opts ...Option) http.Handler {
+	cfg := NewConfig(opts...)
+	return wrap(NewProxy(target, opts...), cfg, rateLimiterFor(cfg))
+}
+
+// middleware wraps an http.Handler with additional behavior.
+type middleware func(http.Handler) http.Handler
+
+// wrap applies the middleware enabled in cfg around h.
+// The first middleware in the list is the outermost. limiter, if not nil,
+// rate limits clients.
+func wrap(h http.Handler, cfg *Config, limiter *rateLimiter) http.Handler {
+	trusted, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		cfg.Logger.Printf("ignoring trusted proxies: %s", err)
+	}
+
+	var chain []middleware
+	if len(trusted) > 0 {
+		chain = append(chain, resolveClient(trusted))
+	}
+	if cfg.MetricsRegistry != nil {
+		// outermost, so requests rejected by other middleware are counted too.
+		if m, err := newProxyMetrics(cfg.MetricsRegistry, cfg.BodySizeBuckets); err != nil {
+			cfg.Logger.Printf("disabling metrics: %s", err)
+		} else {
+			chain = append(chain, m.instrument)
+		}
+		if b, ok := cfg.Balancer.(*AdaptiveBalancer); ok && cfg.EjectionThreshold > 0 {
+			if _, err := register[prometheus.Collector](cfg.MetricsRegistry, &ejectionCollector{balancer: b}); err != nil {
+				cfg.Logger.Printf("not exporting upstream ejections: %s", err)
+			}
+		}
+	}
+	if cfg.AccessLog != nil {
+		chain = append(chain, accessLog(cfg.AccessLog, cfg.RequestIDHeader))
+	}
+	if cfg.TracerProvider != nil {
+		chain = append(chain, tracing(cfg.TracerProvider))
+	}
+	// beneath logging and metrics, so recovered panics are counted as 500s.
+	chain = append(chain, recoverPanics(cfg))
+	if cfg.WatchdogTimeout > 0 {
+		chain = append(chain, watchdog(cfg.WatchdogTimeout, cfg.Logger))
+	}
+	if cfg.RequestDeadline > 0 {
+		chain = append(chain, requestDeadline(cfg.RequestDeadline, cfg))
+	}
+	if cfg.BodyReadTimeout > 0 {
+		chain = append(chain, bodyReadTimeout(cfg.BodyReadTimeout, cfg))
+	}
+	if cfg.MaxRequestBytes > 0 {
+		chain = append(chain, limitRequestBody(cfg.MaxRequestBytes))
+	}
+	if len(cfg.AllowedCIDRs) > 0 || len(cfg.DeniedCIDRs) > 0 {
+		chain = append(chain, filterClients(cfg))
+	}
+	if cfg.RequireTLS {
+		chain = append(chain, requireTLS(trusted))
+	}
+	if len(cfg.CORS) > 0 {
+		chain = append(chain, cors(cfg.CORS))
+	}
+	if limiter != nil {
+		chain = append(chain, rateLimit(limiter))
+	}
+	if cfg.IdempotencyStore != nil {
+		chain = append(chain, idempotency(cfg.IdempotencyStore, cfg.IdempotencyTTL))
+	}
+	if cfg.MaxConcurrent > 0 {
+		l := newConcurrencyLimiter(cfg.MaxConcurrent, cfg.QueueTimeout, cfg.MaxQueuedPerClient)
+		if cfg.MetricsRegistry != nil {
+			// handlers sharing a registry share the gauge, summing their counts.
+			g, err := register(cfg.MetricsRegistry, l.inFlight)
+			if err != nil {
+				cfg.Logger.Printf("not exporting in-flight requests: %s", err)
+			}
+			l.inFlight = g
+		}
+		chain = append(chain, l.limit)
+	}
+	chain = append(chain, normalizeRequestID(cfg))
+	if cfg.DefaultHost != "" || cfg.RejectMissingHost {
+		chain = append(chain, missingHost(cfg))
+	}
+	if cfg.ValidateChecksums {
+		chain = append(chain, validateChecksum)
+	}
+	if cfg.BufferedBodyBytes > 0 {
+		chain = append(chain, bufferBody(cfg.BufferedBodyBytes))
+	}
+	if cfg.Shadow != nil && (cfg.ShadowFraction > 0 || len(cfg.ShadowRules) > 0) {
+		// beneath bufferBody, so buffered bodies can be copied.
+		chain = append(chain, shadow(cfg))
+	}
+	if cfg.TokenFields != nil {
+		chain = append(chain, countTokens(cfg))
+	}
+	if cfg.DisableHTTP10KeepAlive {
+		chain = append(chain, closeHTTP10)
+	}
+	if cfg.AllowedUpgrades != nil {
+		chain = append(chain, restrictUpgrades(cfg.AllowedUpgrades))
+	}
+	if len(cfg.Features) > 0 {
+		chain = append(chain, featureFlags(cfg.Features))
+	}
+	if cfg.GRPCWeb {
+		chain = append(chain, grpcWeb)
+	}
+	if cfg.Broadcast {
+		chain = append(chain, broadcast)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
@@ -0,0 +1,1109 @@
+package internal
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Config holds the optional behavior shared by NewProxy and NewServer.
+// It is populated by applying Options over the defaults.
+type Config struct {
+	// TokenSource, when set, supplies a bearer token for upstream requests
+	// that don't already carry an Authorization header.
+	TokenSource TokenSource
+
+	// APIKeys are injected as bearer tokens into upstream requests that don't
+	// already carry an Authorization header. When the upstream rejects a key
+	// with 401 or 403, the next key is used from then on.
+	APIKeys []string
+
+	// APIKeyRoundRobin uses APIKeys in turn for successive requests,
+	// instead of sticking with one key until it is rejected.
+	APIKeyRoundRobin bool
+
+	// ForceAPIKey injects APIKeys even over a client-supplied Authorization header.
+	ForceAPIKey bool
+
+	// MaxClientRetries caps the retries a single client may trigger within
+	// ClientRetryWindow. Beyond the cap, that client's requests are not retried.
+	MaxClientRetries  int
+	ClientRetryWindow time.Duration
+
+	// Balancer, when set, picks the upstream target for each request
+	// instead of the single target passed to NewProxy.
+	Balancer Balancer
+
+	// ResetRetries is how many times an idempotent request is retried when
+	// the upstream resets the connection before responding.
+	ResetRetries int
+
+	// ValidateChecksums rejects request bodies that don't match their
+	// Content-MD5 or Digest header.
+	ValidateChecksums bool
+
+	// UpstreamTokenSecret is the HMAC key for verifying per-request upstream
+	// override tokens. Overrides are disabled when empty.
+	UpstreamTokenSecret []byte
+
+	// UpstreamOverrideHosts are the only hosts override tokens may route to,
+	// as host:port, or a hostname matching any port.
+	UpstreamOverrideHosts []string
+
+	// DefaultHost is used as the Host of requests that omit it (HTTP/1.0 clients).
+	DefaultHost string
+
+	// RejectMissingHost answers requests without a Host header with 400.
+	// It's mutually exclusive with DefaultHost; Validate rejects setting both.
+	RejectMissingHost bool
+
+	// DisableHTTP10KeepAlive closes HTTP/1.0 connections after each response,
+	// even when the client asked for keep-alive.
+	DisableHTTP10KeepAlive bool
+
+	// GRPCWeb translates gRPC-Web requests from browsers into gRPC for the upstream.
+	GRPCWeb bool
+
+	// TrustedProxies lists the CIDRs (or bare IPs) of proxies in front of us,
+	// whose forwarding headers are believed.
+	TrustedProxies []string
+
+	// AllowedCIDRs, if any, are the only clients let in, and DeniedCIDRs are
+	// kept out, even if also allowed. Both accept bare IPs.
+	AllowedCIDRs []string
+	DeniedCIDRs  []string
+
+	// RequireTLS rejects requests that did not originally arrive over HTTPS.
+	RequireTLS bool
+
+	// BodyReadTimeout is the deadline for reading the full request body.
+	// Zero leaves body reads bounded only by the server's ReadTimeout.
+	BodyReadTimeout time.Duration
+
+	// EmptyAsNoContent turns empty 200 responses from the upstream into 204s.
+	EmptyAsNoContent bool
+
+	// DisableXForwarded stops the proxy from setting X-Forwarded-* headers upstream.
+	DisableXForwarded bool
+
+	// ErrorBodyLogLimit logs up to this many bytes of upstream error response
+	// bodies, decompressing gzip. Zero disables error body logging.
+	ErrorBodyLogLimit int64
+
+	// AllowedUpgrades restricts which protocols clients may upgrade to
+	// (e.g. "websocket"). Nil allows every upgrade to pass through.
+	AllowedUpgrades []string
+
+	// RejectDuplicateRequestID answers requests carrying more than one
+	// X-Request-Id with 400, instead of keeping the first.
+	RejectDuplicateRequestID bool
+
+	// RequestID assigns a random ID to requests without one, forwards it
+	// upstream and echoes it on the response, in the RequestIDHeader header.
+	// RequestIDHeader defaults to X-Request-Id.
+	RequestID       bool
+	RequestIDHeader string
+
+	// Deprecations adds Deprecation/Sunset headers to responses on legacy routes.
+	Deprecations []Deprecation
+
+	// Features are experimental behaviors clients can enable per request
+	// with the X-Feature header.
+	Features []Feature
+
+	// StripReferer and StripOrigin drop the respective client headers before
+	// forwarding, so the upstream doesn't learn where requests came from.
+	StripReferer bool
+	StripOrigin  bool
+
+	// Transport replaces the proxy's own tuned http.Transport for upstream
+	// requests. The proxy's retry, API key and balancing layers still wrap it.
+	Transport http.RoundTripper
+
+	// MaxIdleConns and MaxIdleConnsPerHost tune the default transport's
+	// connection pool. Zero keeps http.Transport's defaults: no overall cap and
+	// 2 per host. They're ignored when Transport is set.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// RequestDeadline bounds each request end to end, across reading the body,
+	// the upstream round trip and writing the response. Stalled requests get a
+	// 504 if nothing has been written yet. Zero disables the deadline.
+	RequestDeadline time.Duration
+
+	// RetryAttempts is the most attempts made for a request when the upstream
+	// is unavailable, including the first. Values below 2 disable retries.
+	// RetryBaseDelay is the delay before the first retry, doubling after each.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+
+	// TokenFields are the JSON request body fields whose text is counted as
+	// prompt tokens and logged per request. Nil disables token counting.
+	TokenFields []string
+
+	// RespectRetryAfter makes the proxy wait out 429 responses for as long as
+	// their Retry-After header asks and try again, rather than passing them on.
+	// RetryAfterMaxWait caps the total wait per request. Defaults to 10s.
+	RespectRetryAfter bool
+	RetryAfterMaxWait time.Duration
+
+	// HealthPath is served by Server itself, never proxied, for liveness and
+	// readiness probes. It reports 200 while the upstream answers a HEAD to
+	// HealthCheckPath within HealthCheckTimeout, 503 otherwise. With an
+	// AdaptiveBalancer, any healthy target will do; see WeightedTarget for
+	// per-target paths. Defaults to /healthz; empty disables it.
+	HealthPath         string
+	HealthCheckPath    string
+	HealthCheckTimeout time.Duration
+
+	// HealthyStatus is the status a healthy upstream answers probes with.
+	// Zero accepts anything short of a server error.
+	HealthyStatus int
+
+	// MetricsRegistry receives request count, latency and body size metrics,
+	// which Server also exposes on /metrics. Nil disables metrics.
+	MetricsRegistry *prometheus.Registry
+
+	// BodySizeBuckets are the buckets, in bytes, of the request and response
+	// body size histograms. Empty uses DefaultBodySizeBuckets.
+	BodySizeBuckets []float64
+
+	// StaticResponses are served by Server itself for their exact paths,
+	// without forwarding, e.g. /robots.txt or /.well-known/security.txt.
+	StaticResponses map[string]StaticResponse
+
+	// AccessLog receives a structured entry for every request. Nil disables it.
+	AccessLog *slog.Logger
+
+	// ErrorHandler answers requests that failed to get an upstream response.
+	// Defaults to a JSON error body with a 502, or 504 on timeouts.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// FlushInterval is how often response bodies are flushed to the client
+	// while being copied from the upstream. Defaults to 10ms.
+	// See httputil.ReverseProxy.FlushInterval.
+	FlushInterval time.Duration
+
+	// Broadcast lets GET requests naming the same stream in the
+	// X-Broadcast-Stream header share one upstream request, each receiving
+	// its response as it streams, e.g. to fan out SSE events.
+	Broadcast bool
+
+	// RateLimit is the sustained requests per second allowed for each client,
+	// identified by its Authorization header once the upstream has accepted it,
+	// or else its IP, with bursts of up to RateLimitBurst. Zero disables rate
+	// limiting.
+	RateLimit      float64
+	RateLimitBurst int
+
+	// RateLimitStateFile, when set, is where Server.Shutdown saves each
+	// client's rate limit, and where the next NewServer or NewHandler restores
+	// them from, so restarting doesn't hand every client a full burst.
+	RateLimitStateFile string
+
+	// FirstByteTimeout bounds how long the upstream may take to send the first
+	// byte of the body once headers have arrived, separately from the transport's
+	// response header timeout. Exceeding it is answered with a 504.
+	// Zero disables it.
+	FirstByteTimeout time.Duration
+
+	// MaxConcurrent caps the requests proxied at once. Requests that can't get
+	// a slot within QueueTimeout are answered with a 503. Zero means no cap.
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+
+	// MaxQueuedPerClient caps how many of one client's requests may wait for
+	// a MaxConcurrent slot at once; more are answered with a 429. Zero means
+	// no cap.
+	MaxQueuedPerClient int
+
+	// LogHeaderDiffs logs the headers the proxy added, removed or modified on
+	// each request to the upstream and each response from it, for debugging.
+	// Credentials are redacted.
+	LogHeaderDiffs bool
+
+	// EjectionThreshold is how many consecutive failed requests eject an
+	// AdaptiveBalancer target from rotation for EjectionDuration, after which
+	// it's tried again. Zero disables ejection. Defaults to 30s.
+	EjectionThreshold int
+	EjectionDuration  time.Duration
+
+	// BufferedBodyBytes, when positive, buffers request bodies of up to that
+	// many bytes so they can be replayed, making e.g. POSTs retryable by
+	// WithRetry. Larger bodies are streamed and never retried.
+	BufferedBodyBytes int64
+
+	// MaxRequestBytes and MaxResponseBytes limit the size of request and
+	// upstream response bodies. Zero means no limit.
+	MaxRequestBytes  int64
+	MaxResponseBytes int64
+
+	// SummaryTrailers names the summary trailers, such as X-Upstream-Duration,
+	// sent to the client after each response body. Nil sends none.
+	SummaryTrailers []string
+
+	// CORS has the proxy answer OPTIONS requests and set CORS headers itself
+	// on the paths of each policy. OPTIONS requests elsewhere are forwarded.
+	CORS []CORSPolicy
+
+	// StripRequestHeaders are removed from requests before they're forwarded,
+	// and StripResponseHeaders from upstream responses. Names are matched
+	// case-insensitively.
+	StripRequestHeaders  []string
+	StripResponseHeaders []string
+
+	// StripQueryParams are removed from request URLs before they're forwarded.
+	// Names are matched exactly.
+	StripQueryParams []string
+
+	// RequestBodyTransformer, when set, rewrites request bodies before
+	// they're forwarded.
+	RequestBodyTransformer RequestBodyTransformer
+
+	// IdempotencyStore, when set, keeps responses to requests carrying an
+	// Idempotency-Key for IdempotencyTTL, replaying them to repeats of the
+	// request instead of forwarding those upstream.
+	IdempotencyStore IdempotencyStore
+	IdempotencyTTL   time.Duration
+
+	// DebugEndpoints has Server expose pprof and expvar under /debug/, on a
+	// separate listener at AdminAddress if set, or else alongside the proxy.
+	// Either way, /debug/ paths are never proxied.
+	DebugEndpoints bool
+	AdminAddress   string
+
+	// DeadlineHint sends the upstream the time left before the request's
+	// deadline, in milliseconds, in the X-Request-Timeout-Ms header.
+	DeadlineHint bool
+
+	// Shadow, if set, receives a copy of ShadowFraction of requests, whose
+	// responses are discarded. Copies are abandoned after ShadowTimeout.
+	// ShadowRules, if any, sample requests by their attributes instead.
+	Shadow         *url.URL
+	ShadowFraction float64
+	ShadowTimeout  time.Duration
+	ShadowRules    []ShadowRule
+
+	// Canary, if set, serves CanaryFraction of requests in place of the
+	// primary upstream, along with any whose CanaryHeader is CanaryHeaderValue.
+	Canary            *url.URL
+	CanaryFraction    float64
+	CanaryHeader      string
+	CanaryHeaderValue string
+
+	// TracerProvider traces requests, passing their spans on to the upstream.
+	// Defaults to a no-op provider.
+	TracerProvider trace.TracerProvider
+
+	// WatchdogTimeout, when positive, is the most time any request may take.
+	// Requests still running after it have their connections closed.
+	WatchdogTimeout time.Duration
+
+	// Logger receives proxy and server diagnostics. Defaults to the standard logger.
+	Logger *log.Logger
+
+	// DrainLogInterval is how often Shutdown reports the number of requests
+	// still in flight while draining.
+	DrainLogInterval time.Duration
+
+	// ReadTimeout, WriteTimeout, IdleTimeout and ReadHeaderTimeout are passed
+	// through to the http.Server built by NewServer. Zero disables a timeout;
+	// WriteTimeout in particular must be 0 for long-lived SSE streams, which
+	// would otherwise be cut off mid-completion.
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+
+	// MaxHeaderBytes caps the size of request headers the server accepts,
+	// e.g. to allow long bearer tokens. Larger requests get a 431.
+	// Zero uses net/http's default of 1MB.
+	MaxHeaderBytes int
+}
+
+// Option mutates a Config. Options are applied in order.
+type Option func(*Config)
+
+// NewConfig applies opts over the default configuration.
+// It's mainly useful for validating options up front; see Config.Validate.
+func NewConfig(opts ...Option) *Config {
+	cfg := &Config{
+		Logger:             log.Default(),
+		DrainLogInterval:   time.Second,
+		ReadTimeout:        5 * time.Second,
+		WriteTimeout:       10 * time.Second,
+		IdleTimeout:        30 * time.Second,
+		ReadHeaderTimeout:  2 * time.Second,
+		RetryAfterMaxWait:  10 * time.Second,
+		HealthPath:         "/healthz",
+		HealthCheckPath:    "/",
+		HealthCheckTimeout: 2 * time.Second,
+		FlushInterval:      10 * time.Millisecond,
+		EjectionDuration:   30 * time.Second,
+		RequestIDHeader:    RequestIDHeader,
+		ShadowTimeout:      10 * time.Second,
+		TracerProvider:     noop.NewTracerProvider(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithTokenSource injects bearer tokens from ts into upstream requests.
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Config) {
+		c.TokenSource = ts
+	}
+}
+
+// WithLogger sends proxy and server diagnostics to l.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+// WithDrainLogInterval sets how often Shutdown logs drain progress.
+func WithDrainLogInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.DrainLogInterval = d
+	}
+}
+
+// WithReadTimeout sets the server's read timeout. Defaults to 5s; 0 disables it.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout sets the server's write timeout. Defaults to 10s.
+// Set it to 0 to disable it, which is needed for long-lived SSE streams.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.WriteTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long keep-alive connections may sit idle. Defaults to 30s.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.IdleTimeout = d
+	}
+}
+
+// WithMaxHeaderBytes sets the largest request headers the server accepts.
+func WithMaxHeaderBytes(n int) Option {
+	return func(c *Config) {
+		c.MaxHeaderBytes = n
+	}
+}
+
+// WithReadHeaderTimeout sets the server's read header timeout. Defaults to 2s.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.ReadHeaderTimeout = d
+	}
+}
+
+// WithBalancer spreads requests across the targets managed by b.
+func WithBalancer(b Balancer) Option {
+	return func(c *Config) {
+		c.Balancer = b
+	}
+}
+
+// WithRetryOnReset retries idempotent requests up to retries times when the
+// upstream resets the connection before any response is sent to the client.
+func WithRetryOnReset(retries int) Option {
+	return func(c *Config) {
+		c.ResetRetries = retries
+	}
+}
+
+// WithChecksumValidation verifies Content-MD5 and Digest request headers
+// against the request body before forwarding, rejecting mismatches with 400.
+// Checked bodies are buffered in memory, so those over 32 MiB get a 413.
+func WithChecksumValidation() Option {
+	return func(c *Config) {
+		c.ValidateChecksums = true
+	}
+}
+
+// WithDefaultHost supplies host for legacy requests that arrive without a Host header.
+func WithDefaultHost(host string) Option {
+	return func(c *Config) {
+		c.DefaultHost = host
+	}
+}
+
+// WithRejectMissingHost rejects legacy requests without a Host header with 400.
+func WithRejectMissingHost() Option {
+	return func(c *Config) {
+		c.RejectMissingHost = true
+	}
+}
+
+// WithSignedUpstreamOverride lets callers choose the upstream for a request by
+// presenting a token signed with secret in the X-Upstream-Token header. Only
+// unexpired tokens for one of allowedHosts are honored.
+// See SignUpstream for issuing tokens.
+func WithSignedUpstreamOverride(secret []byte, allowedHosts ...string) Option {
+	return func(c *Config) {
+		c.UpstreamTokenSecret = secret
+		c.UpstreamOverrideHosts = allowedHosts
+	}
+}
+
+// WithoutHTTP10KeepAlive closes HTTP/1.0 client connections after every response.
+func WithoutHTTP10KeepAlive() Option {
+	return func(c *Config) {
+		c.DisableHTTP10KeepAlive = true
+	}
+}
+
+// WithAPIKeys injects upstream API keys, rotating to the next key when one is
+// rejected with 401/403, whatever the request's method. Only idempotent
+// requests are retried with the next key straight away.
+func WithAPIKeys(keys ...string) Option {
+	return func(c *Config) {
+		c.APIKeys = keys
+	}
+}
+
+// WithAPIKey injects a single upstream API key as a bearer token.
+// It's shorthand for WithAPIKeys(key).
+func WithAPIKey(key string) Option {
+	return WithAPIKeys(key)
+}
+
+// WithForceAPIKey makes the configured API key replace any Authorization
+// header the client sent, instead of deferring to it.
+func WithForceAPIKey(force bool) Option {
+	return func(c *Config) {
+		c.ForceAPIKey = force
+	}
+}
+
+// WithClientRetryLimit allows each client at most max upstream retries per window.
+func WithClientRetryLimit(max int, window time.Duration) Option {
+	return func(c *Config) {
+		c.MaxClientRetries = max
+		c.ClientRetryWindow = window
+	}
+}
+
+// WithGRPCWeb translates binary gRPC-Web requests to gRPC toward the upstream,
+// and the upstream's gRPC responses back to gRPC-Web.
+func WithGRPCWeb() Option {
+	return func(c *Config) {
+		c.GRPCWeb = true
+	}
+}
+
+// WithTrustedProxies trusts forwarding headers from peers within cidrs, e.g. a
+// load balancer. Their requests are taken to come from the rightmost address
+// in X-Forwarded-For that isn't trusted too, for rate limiting, access logs
+// and the chain sent upstream. That chain, merged into a single header, starts
+// at the client and ends with the peer's own address.
+func WithTrustedProxies(cidrs []string) Option {
+	return func(c *Config) {
+		c.TrustedProxies = cidrs
+	}
+}
+
+// WithAllowedCIDRs rejects requests with a 403 unless they come from cidrs.
+// Behind a load balancer, combine with WithTrustedProxies so the real client
+// is checked rather than the balancer.
+func WithAllowedCIDRs(cidrs []string) Option {
+	return func(c *Config) {
+		c.AllowedCIDRs = cidrs
+	}
+}
+
+// WithDeniedCIDRs rejects requests from cidrs with a 403, even if
+// WithAllowedCIDRs lets them in.
+func WithDeniedCIDRs(cidrs []string) Option {
+	return func(c *Config) {
+		c.DeniedCIDRs = cidrs
+	}
+}
+
+// WithRequireTLS rejects plain HTTP requests with 403. Behind a TLS-terminating
+// load balancer, combine with WithTrustedProxies so its X-Forwarded-Proto is honored.
+func WithRequireTLS() Option {
+	return func(c *Config) {
+		c.RequireTLS = true
+	}
+}
+
+// WithBodyReadTimeout bounds the time allowed to read the full request body.
+func WithBodyReadTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.BodyReadTimeout = d
+	}
+}
+
+// WithEmptyAsNoContent maps empty 200 responses from the upstream to 204 No Content.
+func WithEmptyAsNoContent() Option {
+	return func(c *Config) {
+		c.EmptyAsNoContent = true
+	}
+}
+
+// WithoutXForwarded stops the proxy from sending X-Forwarded-For, -Host and
+// -Proto to the upstream. Client-supplied values are dropped either way.
+func WithoutXForwarded() Option {
+	return func(c *Config) {
+		c.DisableXForwarded = true
+	}
+}
+
+// WithErrorBodyLogging logs up to limit bytes of upstream 4xx/5xx response bodies.
+// Gzip'd bodies are decompressed before logging; the client receives them as sent.
+func WithErrorBodyLogging(limit int64) Option {
+	return func(c *Config) {
+		c.ErrorBodyLogLimit = limit
+	}
+}
+
+// WithAPIKeyRoundRobin rotates through the keys from WithAPIKeys on every
+// request, spreading usage across each key's quota.
+func WithAPIKeyRoundRobin() Option {
+	return func(c *Config) {
+		c.APIKeyRoundRobin = true
+	}
+}
+
+// WithAllowedUpgrades only passes through upgrade requests for the given
+// protocols, rejecting others with 400. Without it, all upgrades pass through.
+func WithAllowedUpgrades(protocols ...string) Option {
+	return func(c *Config) {
+		if protocols == nil {
+			protocols = []string{}
+		}
+		c.AllowedUpgrades = protocols
+	}
+}
+
+// WithRejectDuplicateRequestID rejects requests with multiple X-Request-Id
+// values (or see WithRequestIDHeader) with 400. By default, only the first
+// value is kept.
+func WithRejectDuplicateRequestID() Option {
+	return func(c *Config) {
+		c.RejectDuplicateRequestID = true
+	}
+}
+
+// WithDeprecation marks requests under d.PathPrefix as deprecated, adding
+// Deprecation and Sunset headers to their responses. It may be repeated.
+func WithDeprecation(d Deprecation) Option {
+	return func(c *Config) {
+		c.Deprecations = append(c.Deprecations, d)
+	}
+}
+
+// WithFeature registers an experimental behavior that clients can enable for a
+// request by naming it in the X-Feature header. It may be repeated; names not
+// registered this way can't be enabled.
+func WithFeature(name string, mw func(http.Handler) http.Handler) Option {
+	return func(c *Config) {
+		c.Features = append(c.Features, Feature{Name: name, Middleware: mw})
+	}
+}
+
+// WithoutReferer strips the client's Referer header before forwarding upstream.
+func WithoutReferer() Option {
+	return func(c *Config) {
+		c.StripReferer = true
+	}
+}
+
+// WithoutOrigin strips the client's Origin header before forwarding upstream.
+func WithoutOrigin() Option {
+	return func(c *Config) {
+		c.StripOrigin = true
+	}
+}
+
+// WithTransport makes the proxy send upstream requests through rt instead of
+// its default transport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Config) {
+		c.Transport = rt
+	}
+}
+
+// WithMaxIdleConns caps idle upstream connections across all hosts.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Config) {
+		c.MaxIdleConns = n
+	}
+}
+
+// WithMaxIdleConnsPerHost caps idle upstream connections kept per host.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *Config) {
+		c.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithRequestDeadline terminates requests that haven't completed within d,
+// whichever phase they're stalled in.
+func WithRequestDeadline(d time.Duration) Option {
+	return func(c *Config) {
+		c.RequestDeadline = d
+	}
+}
+
+// WithRetry retries GET/HEAD requests and requests with an Idempotency-Key
+// header, up to maxAttempts in total, when the upstream refuses the connection,
+// times out, or answers 502/503/504. Requests with a body are only retried when
+// it's buffered; see WithBufferedBody to retry POSTs. The number of retries is
+// reported in X-Proxy-Retries.
+func WithRetry(maxAttempts int, baseDelay time.Duration) Option {
+	return func(c *Config) {
+		c.RetryAttempts = maxAttempts
+		c.RetryBaseDelay = baseDelay
+	}
+}
+
+// WithTokenCounting logs an approximate prompt token count for JSON requests,
+// counting the text in the given dotted field paths, or DefaultTokenFields
+// if none are given.
+func WithTokenCounting(fields ...string) Option {
+	return func(c *Config) {
+		if len(fields) == 0 {
+			fields = DefaultTokenFields
+		}
+		c.TokenFields = fields
+	}
+}
+
+// WithRespectRetryAfter retries requests the upstream rate limited with a 429
+// once its Retry-After has elapsed, up to RetryAfterMaxWait in total and at
+// most 5 times. Waits are at least 100ms, whatever the Retry-After says.
+func WithRespectRetryAfter(respect bool) Option {
+	return func(c *Config) {
+		c.RespectRetryAfter = respect
+	}
+}
+
+// WithRetryAfterMaxWait caps how long a request may be held waiting out 429s.
+// A Retry-After that would exceed it is passed on to the client instead.
+func WithRetryAfterMaxWait(d time.Duration) Option {
+	return func(c *Config) {
+		c.RetryAfterMaxWait = d
+	}
+}
+
+// WithHealthPath sets the path Server answers health probes on, instead of
+// proxying it. An empty path disables the endpoint.
+func WithHealthPath(path string) Option {
+	return func(c *Config) {
+		c.HealthPath = path
+	}
+}
+
+// WithUpstreamHealthCheck sets the upstream path health probes check, and how
+// long the upstream has to respond.
+// Balanced targets may override the path; see WeightedTarget.
+func WithUpstreamHealthCheck(path string, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.HealthCheckPath = path
+		c.HealthCheckTimeout = timeout
+	}
+}
+
+// WithMetrics records Prometheus metrics for requests in a registry of their
+// own, exposed by Server on /metrics.
+func WithMetrics() Option {
+	// created here, not in the closure, so every Config built from these
+	// options shares one registry.
+	return WithMetricsRegistry(prometheus.NewRegistry())
+}
+
+// WithMetricsRegistry records Prometheus metrics for requests in reg,
+// e.g. to gather them in tests or alongside an application's own metrics.
+func WithMetricsRegistry(reg *prometheus.Registry) Option {
+	return func(c *Config) {
+		c.MetricsRegistry = reg
+	}
+}
+
+// WithBodySizeBuckets sets the buckets, in bytes, of the request and response
+// body size histograms recorded when metrics are enabled. They must be
+// strictly increasing.
+func WithBodySizeBuckets(buckets ...float64) Option {
+	return func(c *Config) {
+		c.BodySizeBuckets = buckets
+	}
+}
+
+// WithStaticResponse makes Server answer path with a fixed body instead of
+// proxying it. It may be repeated for different paths.
+func WithStaticResponse(path, contentType, body string) Option {
+	return func(c *Config) {
+		if c.StaticResponses == nil {
+			c.StaticResponses = map[string]StaticResponse{}
+		}
+		c.StaticResponses[path] = StaticResponse{ContentType: contentType, Body: body}
+	}
+}
+
+// WithHealthyStatus makes health probes require exactly status from the upstream.
+func WithHealthyStatus(status int) Option {
+	return func(c *Config) {
+		c.HealthyStatus = status
+	}
+}
+
+// WithAccessLog logs method, path, status, bytes written, latency and client
+// IP for every request to logger. Pass a logger with a slog.JSONHandler for
+// JSON output, or a slog.TextHandler for text. 5xx responses are logged at
+// error level, 4xx at warn and the rest at info.
+func WithAccessLog(logger *slog.Logger) Option {
+	return func(c *Config) {
+		c.AccessLog = logger
+	}
+}
+
+// WithErrorHandler replaces the proxy's JSON error responses for failed
+// upstream requests with fn.
+func WithErrorHandler(fn func(http.ResponseWriter, *http.Request, error)) Option {
+	return func(c *Config) {
+		c.ErrorHandler = fn
+	}
+}
+
+// WithFlushInterval sets how often response bodies are flushed to the client.
+// -1 flushes after every write, which is best for token-by-token streaming;
+// 0 uses Go's default of not flushing periodically at all; a positive value
+// flushes that often. Regardless, ReverseProxy flushes SSE and other responses
+// without a Content-Length (e.g. chunked streams) after every write.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.FlushInterval = d
+	}
+}
+
+// WithBroadcast fans out one upstream stream to every client subscribing to
+// it by ID with the X-Broadcast-Stream header. Subscribers joining a running
+// stream receive events from then on.
+func WithBroadcast() Option {
+	return func(c *Config) {
+		c.Broadcast = true
+	}
+}
+
+// WithRateLimit limits each client to rps requests per second, with bursts of
+// up to burst. Clients over their limit get a 429 with Retry-After without
+// the request reaching the upstream.
+func WithRateLimit(rps float64, burst int) Option {
+	return func(c *Config) {
+		c.RateLimit = rps
+		c.RateLimitBurst = burst
+	}
+}
+
+// WithRateLimitStateFile keeps WithRateLimit's limits across restarts by
+// saving them to path on Shutdown and restoring them on startup. A missing
+// file starts every client afresh.
+func WithRateLimitStateFile(path string) Option {
+	return func(c *Config) {
+		c.RateLimitStateFile = path
+	}
+}
+
+// WithFirstByteTimeout answers with a 504 when the upstream sends headers but
+// no body within d, e.g. a stream that never starts.
+func WithFirstByteTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.FirstByteTimeout = d
+	}
+}
+
+// WithMaxConcurrent limits the proxy to n requests in flight at once, shedding
+// the rest with a 503 and Retry-After. The current count is exported as the
+// cohere_proxy_in_flight_requests gauge when metrics are enabled.
+func WithMaxConcurrent(n int) Option {
+	return func(c *Config) {
+		c.MaxConcurrent = n
+	}
+}
+
+// WithQueueTimeout lets requests over the WithMaxConcurrent limit wait up to d
+// for a slot before being shed. By default they are shed immediately.
+func WithQueueTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.QueueTimeout = d
+	}
+}
+
+// WithMaxQueuedPerClient lets each client have at most n requests waiting
+// for a WithMaxConcurrent slot, so one client can't fill the queue. Further
+// requests are rejected with a 429. Clients are told apart by IP.
+func WithMaxQueuedPerClient(n int) Option {
+	return func(c *Config) {
+		c.MaxQueuedPerClient = n
+	}
+}
+
+// WithHeaderDiffLogging logs how the proxy changed each request's and
+// response's headers on their way through it. It's verbose; meant for debugging.
+func WithHeaderDiffLogging() Option {
+	return func(c *Config) {
+		c.LogHeaderDiffs = true
+	}
+}
+
+// WithEjectionThreshold ejects a balancer target from rotation after n
+// consecutive requests to it fail, until WithEjectionDuration has passed.
+// If every target is ejected, requests are sent to one of them anyway.
+func WithEjectionThreshold(n int) Option {
+	return func(c *Config) {
+		c.EjectionThreshold = n
+	}
+}
+
+// WithEjectionDuration sets how long an ejected target is kept out of
+// rotation. The first request after that probes it: if it fails too, the
+// target is ejected again.
+func WithEjectionDuration(d time.Duration) Option {
+	return func(c *Config) {
+		c.EjectionDuration = d
+	}
+}
+
+// WithBufferedBody reads request bodies of up to maxBytes into memory so they
+// can be resent, and lets WithRetry retry them whatever their method. Only use
+// it where the upstream tolerates repeats, e.g. Cohere's generate, embed and
+// chat endpoints. Requests over maxBytes are streamed and not retried.
+func WithBufferedBody(maxBytes int64) Option {
+	return func(c *Config) {
+		c.BufferedBodyBytes = maxBytes
+	}
+}
+
+// WithMaxRequestBytes rejects request bodies over n bytes with a 413, before
+// they're forwarded when the Content-Length gives them away, or else as soon
+// as the limit is passed while streaming them upstream.
+func WithMaxRequestBytes(n int64) Option {
+	return func(c *Config) {
+		c.MaxRequestBytes = n
+	}
+}
+
+// WithMaxResponseBytes fails upstream responses over n bytes. Those declaring
+// a larger Content-Length get a 502; others are streamed as usual until they
+// pass the limit, and then cut off.
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *Config) {
+		c.MaxResponseBytes = n
+	}
+}
+
+// WithSummaryTrailers sends the named summary trailers after each response
+// body, for clients that read trailers: UpstreamDurationTrailer,
+// UpstreamStatusTrailer and UpstreamBytesTrailer. With no names, all of them
+// are sent. Responses carrying trailers are chunked, so they lose any
+// Content-Length.
+func WithSummaryTrailers(names ...string) Option {
+	return func(c *Config) {
+		if len(names) == 0 {
+			names = []string{UpstreamDurationTrailer, UpstreamStatusTrailer, UpstreamBytesTrailer}
+		}
+		c.SummaryTrailers = names
+	}
+}
+
+// WithCORS answers OPTIONS requests under p.PathPrefix at the proxy, including
+// CORS preflights, and sets Access-Control-Allow-Origin on responses to
+// allowed origins there. It may be repeated; the longest matching prefix wins.
+func WithCORS(p CORSPolicy) Option {
+	return func(c *Config) {
+		c.CORS = append(c.CORS, p)
+	}
+}
+
+// WithStripRequestHeaders removes the named headers from requests before
+// they're forwarded, e.g. an internal X-Internal-Secret. Names are matched
+// case-insensitively. It may be repeated.
+func WithStripRequestHeaders(names ...string) Option {
+	return func(c *Config) {
+		c.StripRequestHeaders = append(c.StripRequestHeaders, names...)
+	}
+}
+
+// WithStripResponseHeaders removes the named headers from upstream responses,
+// e.g. Server. Names are matched case-insensitively. It may be repeated.
+func WithStripResponseHeaders(names ...string) Option {
+	return func(c *Config) {
+		c.StripResponseHeaders = append(c.StripResponseHeaders, names...)
+	}
+}
+
+// WithStripQueryParams removes the named query parameters from requests before
+// they're forwarded, e.g. an api_key a client put in the URL. Names are matched
+// exactly. It may be repeated.
+func WithStripQueryParams(names ...string) Option {
+	return func(c *Config) {
+		c.StripQueryParams = append(c.StripQueryParams, names...)
+	}
+}
+
+// WithRequestID tags every request with an ID: the client's own, or else a
+// new random UUID. It's forwarded upstream, echoed back on the response and
+// included in access log entries.
+func WithRequestID() Option {
+	return func(c *Config) {
+		c.RequestID = true
+	}
+}
+
+// WithRequestIDHeader carries request IDs in the header name instead of
+// X-Request-Id.
+func WithRequestIDHeader(name string) Option {
+	return func(c *Config) {
+		c.RequestIDHeader = name
+	}
+}
+
+// WithRequestBodyTransformer forwards request bodies as transformed by fn,
+// e.g. to redact or rewrite fields. Transformed bodies are sent chunked, since
+// their length isn't known up front.
+func WithRequestBodyTransformer(fn RequestBodyTransformer) Option {
+	return func(c *Config) {
+		c.RequestBodyTransformer = fn
+	}
+}
+
+// WithIdempotency replays responses to requests repeating an Idempotency-Key
+// within ttl, from an in-memory store, rather than sending them upstream
+// again. Replays carry an Idempotent-Replayed: true header.
+func WithIdempotency(ttl time.Duration) Option {
+	// created here, not in the closure, so every Config built from these
+	// options shares one store.
+	return WithIdempotencyStore(NewMemoryIdempotencyStore(), ttl)
+}
+
+// WithIdempotencyStore is like WithIdempotency, but keeps responses in store,
+// e.g. one shared by several proxy instances.
+func WithIdempotencyStore(store IdempotencyStore, ttl time.Duration) Option {
+	return func(c *Config) {
+		c.IdempotencyStore = store
+		c.IdempotencyTTL = ttl
+	}
+}
+
+// WithDebugEndpoints has Server expose net/http/pprof profiles under
+// /debug/pprof/ and expvar at /debug/vars, for profiling a live proxy. Use
+// WithAdminAddress to keep them away from clients.
+func WithDebugEndpoints() Option {
+	return func(c *Config) {
+		c.DebugEndpoints = true
+	}
+}
+
+// WithAdminAddress serves the debug endpoints on their own listener at addr,
+// e.g. "127.0.0.1:6060", instead of the proxy's. Requests for /debug/ paths
+// on the proxy's listeners then get a 404.
+func WithAdminAddress(addr string) Option {
+	return func(c *Config) {
+		c.AdminAddress = addr
+	}
+}
+
+// WithDeadlineHint tells the upstream how long it has to answer, in the
+// X-Request-Timeout-Ms header, for requests with a deadline such as one set by
+// WithRequestDeadline. Client-supplied values are never passed through.
+func WithDeadlineHint() Option {
+	return func(c *Config) {
+		c.DeadlineHint = true
+	}
+}
+
+// WithShadow copies a fraction (0 to 1) of requests, or those WithShadowRule
+// picks, to target in the background, e.g. to try a new model version on live
+// traffic, and discards its responses. Clients only ever see the primary upstream's response.
+// Copies are stripped and given credentials like any other upstream request.
+// Request bodies buffered by WithBufferedBody are copied whole. Others are
+// passed to the shadow as the primary reads them, holding up the primary for
+// at most 250ms in all if the shadow falls over 1MiB behind, and cutting the
+// shadow off after that.
+// Each copy's outcome, and copies dropped while 64 are already in flight, are
+// logged to the access log at debug level. Shadowed requests and their copies
+// share an X-Shadow-Id, sent to both upstreams and logged as shadow_id.
+func WithShadow(target *url.URL, fraction float64) Option {
+	return func(c *Config) {
+		c.Shadow = target
+		c.ShadowFraction = fraction
+	}
+}
+
+// WithShadowRule shadows rule.Fraction of the requests matching rule, in
+// place of WithShadow's uniform fraction. It may be repeated; each request is
+// sampled by the first rule it matches, and isn't shadowed if it matches none.
+// WithShadow must still set the target.
+func WithShadowRule(rule ShadowRule) Option {
+	return func(c *Config) {
+		c.ShadowRules = append(c.ShadowRules, rule)
+	}
+}
+
+// WithShadowTimeout abandons shadow requests still running after d. It
+// defaults to 10s.
+func WithShadowTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.ShadowTimeout = d
+	}
+}
+
+// WithCanary routes a fraction (0 to 1) of requests to target instead of the
+// primary upstream, for a gradual rollout. Responses say which upstream served
+// them in X-Proxy-Upstream. Requests with a signed upstream override still go
+// where they asked.
+func WithCanary(target *url.URL, fraction float64) Option {
+	return func(c *Config) {
+		c.Canary = target
+		c.CanaryFraction = fraction
+	}
+}
+
+// WithCanaryHeader also routes requests whose header name is value to the
+// canary set by WithCanary, e.g. to try it out by hand. Requests without the
+// header never match, even if value is empty.
+func WithCanaryHeader(name, value string) Option {
+	return func(c *Config) {
+		c.CanaryHeader = name
+		c.CanaryHeaderValue = value
+	}
+}
+
+// WithTracing traces each request with a span from tp, continuing any trace
+// the client sent in traceparent and passing the span on to the upstream the
+// same way. Spans record the response status and the upstream's latency.
+// Upstream responses carry a traceparent naming the span back to the client.
+func WithTracing(tp trace.TracerProvider) Option {
+	return func(c *Config) {
+		c.TracerProvider = tp
+	}
+}
+
+// WithWatchdog kills requests still running after max, however stuck, by
+// closing their connections; it's logged when it does. It backs up the other
+// timeouts, so should be set well above them, e.g. WithRequestDeadline's.
+// Under NewServer, HTTP/2 requests sharing the connection are killed too;
+// elsewhere the connection's reads and writes are made to fail instead.
+func WithWatchdog(max time.Duration) Option {
+	return func(c *Config) {
+		c.WatchdogTimeout = max
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamTokenHeader carries a signed token selecting the upstream for a request.
+const UpstreamTokenHeader = "X-Upstream-Token"
+
+// SignUpstream issues a token allowing the bearer to route requests to
+// upstream until expires. The token is the base64url expiry, as Unix seconds,
+// and upstream URL joined by a space, then a dot and their HMAC-SHA256.
+// The proxy only honors it if upstream's host is one it was configured with.
+func SignUpstream(secret []byte, upstream *url.URL, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10) + " " + upstream.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(secret, payload))
+}
+
+// verifyUpstream checks a token from SignUpstream hasn't expired by now, and
+// returns the upstream it encodes.
+func verifyUpstream(secret []byte, token string, now time.Time) (*url.URL, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed upstream token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upstream token: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upstream token signature: %s", err)
+	}
+
+	if !hmac.Equal(sig, sign(secret, string(payload))) {
+		return nil, fmt.Errorf("invalid upstream token signature")
+	}
+
+	expiry, raw, ok := strings.Cut(string(payload), " ")
+	if !ok {
+		return nil, fmt.Errorf("malformed upstream token: no expiry")
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upstream token expiry: %s", err)
+	}
+	if now.Unix() >= expires {
+		return nil, fmt.Errorf("upstream token expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+
+	upstream, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream in token: %s", err)
+	}
+	if (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		return nil, fmt.Errorf("invalid upstream in token: %q", raw)
+	}
+	return upstream, nil
+}
+
+func sign(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// upstreamOverride returns the upstream named by a valid signed token on req, if any.
+// Invalid tokens are logged and ignored, so the request takes its normal route.
+func upstreamOverride(cfg *Config, req *http.Request) (*url.URL, bool) {
+	token := req.Header.Get(UpstreamTokenHeader)
+	if len(cfg.UpstreamTokenSecret) == 0 || token == "" {
+		return nil, false
+	}
+
+	upstream, err := verifyUpstream(cfg.UpstreamTokenSecret, token, time.Now())
+	if err != nil {
+		cfg.Logger.Printf("ignoring upstream override: %s", err)
+		return nil, false
+	}
+	// a leaked secret mustn't be enough to point the proxy anywhere at all.
+	if !overrideAllowed(cfg.UpstreamOverrideHosts, upstream) {
+		cfg.Logger.Printf("ignoring upstream override: host %q is not allowed", upstream.Host)
+		return nil, false
+	}
+	return upstream, true
+}
+
+// overrideAllowed reports whether upstream's host is in hosts, matching
+// either its host:port or, for entries without a port, its hostname alone.
+func overrideAllowed(hosts []string, upstream *url.URL) bool {
+	for _, host := range hosts {
+		if strings.EqualFold(host, upstream.Host) || strings.EqualFold(host, upstream.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
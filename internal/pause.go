@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// pausableListener can temporarily stop accepting connections without the
+// http.Server noticing. Pausing closes the socket, so new connections are
+// refused by the OS rather than queueing in the backlog; resuming listens on
+// the same address again. Connections accepted before the pause are unaffected.
+type pausableListener struct {
+	addr net.Addr
+	// listen opens a new socket on addr, to resume. Defaults to net.Listen.
+	listen func() (net.Listener, error)
+
+	mu       sync.Mutex
+	listener net.Listener
+	paused   bool
+	closed   bool
+	// resumed is closed to wake Accept when the listener resumes or closes.
+	resumed chan struct{}
+}
+
+func newPausableListener(l net.Listener, listen func() (net.Listener, error)) *pausableListener {
+	addr := l.Addr()
+	if listen == nil {
+		// the resolved address, so a random port (":0") is kept.
+		listen = func() (net.Listener, error) { return net.Listen(addr.Network(), addr.String()) }
+	}
+	return &pausableListener{addr: addr, listen: listen, listener: l}
+}
+
+func (l *pausableListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if l.paused {
+			resumed := l.resumed
+			l.mu.Unlock()
+			<-resumed
+			continue
+		}
+		current := l.listener
+		l.mu.Unlock()
+
+		conn, err := current.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		l.mu.Lock()
+		// the socket was closed out from under us by Pause, not by a real failure.
+		interrupted := !l.closed && (l.paused || current != l.listener)
+		l.mu.Unlock()
+		if interrupted {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// Pause closes the socket so new connections are refused until Resume.
+func (l *pausableListener) Pause() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused || l.closed {
+		return nil
+	}
+	l.paused = true
+	l.resumed = make(chan struct{})
+	return l.listener.Close()
+}
+
+// Resume listens on the original address again and wakes up Accept.
+func (l *pausableListener) Resume() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.paused || l.closed {
+		return nil
+	}
+	listener, err := l.listen()
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	l.paused = false
+	close(l.resumed)
+	return nil
+}
+
+func (l *pausableListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.paused {
+		// the socket is already closed; just release Accept.
+		close(l.resumed)
+		return nil
+	}
+	return l.listener.Close()
+}
+
+// File returns a duplicate of the listening socket's file descriptor, which
+// stays open and listening after this listener closes. It's meant to be
+// handed to a new process so it can take over the socket.
+func (l *pausableListener) File() (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paused || l.closed {
+		return nil, errors.New("listener is not open")
+	}
+	f, ok := l.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener does not support file descriptors")
+	}
+	return f.File()
+}
+
+// Addr returns the original listening address, which is stable across pauses.
+func (l *pausableListener) Addr() net.Addr {
+	return l.addr
+}
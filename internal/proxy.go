@@ -7,11 +7,18 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/http2"
 )
 
 // NewProxy configures a reverse proxy handler for a single upstream target.
-func NewProxy(target *url.URL) *httputil.ReverseProxy {
+// When a Balancer is configured, it chooses the target instead.
+// target isn't checked here; see ValidateTarget.
+func NewProxy(target *url.URL, opts ...Option) *httputil.ReverseProxy {
+	return newProxy(target, NewConfig(opts...))
+}
+
+func newProxy(target *url.URL, cfg *Config) *httputil.ReverseProxy {
 	// create our own non-default transport with reasonable timeouts.
 	transport := &http.Transport{
 		Dial: (&net.Dialer{
@@ -22,25 +29,227 @@ func NewProxy(target *url.URL) *httputil.ReverseProxy {
 		ResponseHeaderTimeout: 10 * time.Second,
 		// Note: this disables H2 in some cases. We're not using it.
 		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
 	}
 
-	// not really used, but would be necessary for HTTP/2
-	// if the upstream supports http2 + https, this may matter.
-	// for https listening endpoint, would additionally need to:
-	// - generate a keypair, add it to http.Server.TLSConfig
-	// - change Serve() to ServeTLS()
-	// - ensure upstream target for proxy also supports H2
+	// lets the proxy speak HTTP/2 to https upstreams that support it.
+	// the listening side negotiates H2 on its own under Server.ServeTLS.
 	http2.ConfigureTransport(transport)
 
+	if b, ok := cfg.Balancer.(*AdaptiveBalancer); ok && cfg.EjectionThreshold > 0 {
+		b.setEjection(cfg.EjectionThreshold, cfg.EjectionDuration)
+	}
+
+	// invalid entries are reported by wrap, or Validate.
+	trusted, _ := parseCIDRs(cfg.TrustedProxies)
+	keys := newKeyRing(cfg.APIKeys, cfg.APIKeyRoundRobin)
+	limiter := newRetryLimiter(cfg.MaxClientRetries, cfg.ClientRetryWindow)
+
+	var rt http.RoundTripper = transport
+	if cfg.Transport != nil {
+		rt = cfg.Transport
+	}
+	if cfg.GRPCWeb {
+		rt = newGRPCTransport(rt)
+	}
+	if cfg.MetricsRegistry != nil {
+		if latency, err := newUpstreamLatency(cfg.MetricsRegistry); err != nil {
+			cfg.Logger.Printf("not exporting upstream latency: %s", err)
+		} else {
+			rt = &latencyTransport{next: rt, latency: latency}
+		}
+	}
+	if cfg.FirstByteTimeout > 0 {
+		rt = &firstByteTransport{next: rt, timeout: cfg.FirstByteTimeout}
+	}
+	rt = &countingTransport{next: rt}
+	if keys != nil {
+		rt = &apiKeyTransport{next: rt, ring: keys, limiter: limiter}
+	}
+	if cfg.ResetRetries > 0 {
+		rt = &resetRetryTransport{next: rt, retries: cfg.ResetRetries, limiter: limiter, logger: cfg.Logger}
+	}
+	if cfg.RetryAttempts > 1 {
+		rt = &retryTransport{next: rt, attempts: cfg.RetryAttempts, base: cfg.RetryBaseDelay, limiter: limiter, logger: cfg.Logger}
+	}
+	if cfg.RespectRetryAfter {
+		rt = &retryAfterTransport{next: rt, maxWait: cfg.RetryAfterMaxWait, limiter: limiter, logger: cfg.Logger}
+	}
+	if cfg.Balancer != nil {
+		rt = &observingTransport{next: rt, balancer: cfg.Balancer}
+	}
+	rt = &tracingTransport{next: rt}
+
+	var bodyErrors *prometheus.CounterVec
+	if cfg.MetricsRegistry != nil {
+		var err error
+		if bodyErrors, err = newBodyErrorCounter(cfg.MetricsRegistry); err != nil {
+			cfg.Logger.Printf("not exporting upstream body errors: %s", err)
+			bodyErrors = nil
+		}
+	}
+
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = proxyError(cfg)
+	}
+
 	return &httputil.ReverseProxy{
-		Transport: transport,
+		Transport:    rt,
+		ErrorLog:     cfg.Logger,
+		ErrorHandler: errorHandler,
 		// Periodically flush data to the client while copying the response body.
-		// Ensures correct streaming behavior.
-		FlushInterval: 10 * time.Millisecond,
+		// Ensures correct streaming behavior. Defaults to 10ms; see WithFlushInterval.
+		// text/event-stream responses and those without a Content-Length ignore this
+		// and flush after every write, so SSE events and heartbeat comments (": ping")
+		// reach clients immediately.
+		FlushInterval: cfg.FlushInterval,
 		Rewrite: func(r *httputil.ProxyRequest) {
+			// By now ReverseProxy has stripped hop-by-hop headers from r.Out, including
+			// any custom ones the client named in its Connection header (RFC 9110 7.6.1).
+			// Headers set below are ours, so they're never subject to that.
+
 			// Be a good neighbor and tell upstream who we're forwarding requests for.
-			r.SetXForwarded()
-			r.SetURL(target)
+			// ReverseProxy has already dropped any X-Forwarded-* headers from the client,
+			// though a trusted proxy's X-Forwarded-For chain is kept and extended.
+			if !cfg.DisableXForwarded {
+				keepForwardedFor(r.In, r.Out, trusted)
+				r.SetXForwarded()
+			}
+			r.Out = r.Out.WithContext(withAttempts(withClient(r.Out.Context(), clientIP(r.In))))
+			if cfg.SummaryTrailers != nil {
+				r.Out = r.Out.WithContext(withUpstreamStart(r.Out.Context()))
+			}
+
+			if upstream, ok := upstreamOverride(cfg, r.In); ok {
+				r.SetURL(upstream)
+			} else if cfg.Canary != nil && routeCanary(cfg, r.In) {
+				r.Out = r.Out.WithContext(withUpstreamName(r.Out.Context(), "canary"))
+				r.SetURL(cfg.Canary)
+			} else {
+				if cfg.Canary != nil {
+					r.Out = r.Out.WithContext(withUpstreamName(r.Out.Context(), "primary"))
+				}
+				if cfg.Balancer != nil {
+					upstream := cfg.Balancer.Next()
+					r.Out = r.Out.WithContext(withTarget(r.Out.Context(), upstream))
+					r.SetURL(upstream)
+				} else {
+					r.SetURL(target)
+				}
+			}
+			// the token is for us, not the upstream.
+			r.Out.Header.Del(UpstreamTokenHeader)
+			if cfg.StripReferer {
+				r.Out.Header.Del("Referer")
+			}
+			if cfg.StripOrigin {
+				r.Out.Header.Del("Origin")
+			}
+			for _, name := range cfg.StripRequestHeaders {
+				r.Out.Header.Del(name)
+			}
+			if len(cfg.StripQueryParams) > 0 {
+				stripQueryParams(r.Out.URL, cfg.StripQueryParams)
+			}
+			// normalizeRequestID has usually assigned one already, unless the proxy isn't
+			// behind NewHandler's middleware.
+			if cfg.RequestID && r.Out.Header.Get(cfg.RequestIDHeader) == "" {
+				r.Out.Header.Set(cfg.RequestIDHeader, newRequestID())
+			}
+
+			if d := matchDeprecation(cfg.Deprecations, r.In.URL.Path); d != nil {
+				r.Out = r.Out.WithContext(withDeprecation(r.Out.Context(), d))
+			}
+
+			// Clients supplying their own credentials take precedence, unless forced.
+			if keys != nil && (cfg.ForceAPIKey || r.Out.Header.Get("Authorization") == "") {
+				index, key := keys.get()
+				r.Out = r.Out.WithContext(withAPIKeyIndex(r.Out.Context(), index))
+				r.Out.Header.Set("Authorization", "Bearer "+key)
+			}
+			if cfg.TokenSource != nil && r.Out.Header.Get("Authorization") == "" {
+				if token, err := cfg.TokenSource.Token(r.Out.Context()); err != nil {
+					// forward anyway; upstream will reject it with a clearer error than we can.
+					cfg.Logger.Printf("failed to get upstream token: %s", err)
+				} else {
+					r.Out.Header.Set("Authorization", "Bearer "+token)
+				}
+			}
+
+			injectTrace(r.Out)
+			if cfg.DeadlineHint {
+				setDeadlineHint(r.Out)
+			}
+			if cfg.RequestBodyTransformer != nil {
+				transformBody(r.Out, cfg.RequestBodyTransformer)
+			}
+
+			if cfg.LogHeaderDiffs {
+				logHeaderDiff(cfg.Logger, "request", r.In, r.In.Header, r.Out.Header)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if cfg.LogHeaderDiffs {
+				upstream := resp.Header.Clone()
+				defer func() { logHeaderDiff(cfg.Logger, "response", resp.Request, upstream, resp.Header) }()
+			}
+
+			// upstream headers, including Cohere's X-RateLimit-* quota headers, reach the
+			// client as-is. the proxy has no limits of its own to merge into them.
+			setAttemptsHeader(resp)
+			checkCredentials(resp)
+			if name := upstreamNameFromContext(resp.Request.Context()); name != "" {
+				resp.Header.Set(ProxyUpstreamHeader, name)
+			}
+			normalizeContentType(resp, cfg.Logger)
+			corsHeaders(resp)
+			traceResponse(resp)
+			if cfg.RequestID {
+				resp.Header.Set(cfg.RequestIDHeader, resp.Request.Header.Get(cfg.RequestIDHeader))
+			}
+			if d := deprecationFromContext(resp.Request.Context()); d != nil {
+				d.header(resp.Header)
+			}
+			if cfg.EmptyAsNoContent {
+				emptyAsNoContent(resp)
+			}
+			for _, name := range cfg.StripResponseHeaders {
+				resp.Header.Del(name)
+			}
+
+			// upgraded connections hand the raw body to ReverseProxy as an io.ReadWriteCloser; leave it be.
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				return nil
+			}
+			if cfg.ErrorBodyLogLimit > 0 {
+				logErrorBody(resp, cfg.ErrorBodyLogLimit, cfg.Logger)
+			}
+			resp.Body = &resetDetectingBody{ReadCloser: resp.Body, req: resp.Request, logger: cfg.Logger, declared: resp.ContentLength, failures: bodyErrors}
+			if cfg.SummaryTrailers != nil {
+				addSummaryTrailers(resp, cfg.SummaryTrailers)
+			}
+			if cfg.MaxResponseBytes > 0 {
+				return limitResponseBody(resp, cfg.MaxResponseBytes)
+			}
+			return nil
 		},
 	}
 }
+
+// stripQueryParams removes the named query parameters from u, leaving its
+// query as it was if none are present.
+func stripQueryParams(u *url.URL, names []string) {
+	q := u.Query()
+	stripped := false
+	for _, name := range names {
+		if q.Has(name) {
+			q.Del(name)
+			stripped = true
+		}
+	}
+	if stripped {
+		u.RawQuery = q.Encode()
+	}
+}
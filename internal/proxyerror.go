@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// proxyError answers requests the proxy couldn't get an upstream response
+// for with a JSON error body, in the shape Cohere's API uses:
+//
+//	{"error":{"message":"...","type":"upstream_unavailable"}}
+//
+// Timeouts, including requests past their deadline, get a 504 and the type
+// upstream_timeout, and request bodies over MaxRequestBytes a 413; anything
+// else is a 502.
+func proxyError(cfg *Config) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		cfg.Logger.Printf("http: proxy error: %v", err)
+		if id := r.Header.Get(cfg.RequestIDHeader); cfg.RequestID && id != "" {
+			w.Header().Set(cfg.RequestIDHeader, id)
+		}
+
+		var mbe *http.MaxBytesError
+		status, kind, message := http.StatusBadGateway, "upstream_unavailable", "the upstream could not be reached"
+		switch {
+		case errors.As(err, &mbe):
+			status, kind, message = http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("the request body exceeds %d bytes", mbe.Limit)
+		case errors.Is(err, errResponseTooLarge):
+			kind, message = "response_too_large", "the upstream response was too large"
+		case isTimeout(r.Context(), err):
+			status, kind, message = http.StatusGatewayTimeout, "upstream_timeout", "the upstream did not respond in time"
+			// a read deadline that fired mid-request leaves the connection unusable
+			// for the next one, so don't keep it alive.
+			w.Header().Set("Connection", "close")
+		}
+
+		writeJSONError(w, status, kind, message)
+	}
+}
+
+// writeJSONError writes an error response in the shape Cohere's API uses.
+func writeJSONError(w http.ResponseWriter, status int, kind, message string) {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	body.Error.Message = message
+	body.Error.Type = kind
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// isTimeout reports whether err means the upstream was too slow, or the
+// request ran out of time. A stalled body read past the request deadline can
+// surface as a canceled context rather than a deadline error.
+func isTimeout(ctx context.Context, err error) bool {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return true
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
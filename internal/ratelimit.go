@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter gives each client its own token bucket, so one noisy client
+// can't spend the upstream quota of everyone else.
+type rateLimiter struct {
+	rps   rate.Limit
+	burst int
+	// idle is how long a client's limiter is kept unused before it's evicted.
+	// By then its bucket has refilled, so a fresh one behaves the same.
+	idle time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+	// verified holds credentials the upstream has accepted, and when it last
+	// did; see key.
+	verified  map[string]time.Time
+	lastSweep time.Time
+}
+
+// maxRateLimitClients caps the clients and credentials tracked at once. Past
+// it, an arbitrary one is forgotten to make room.
+const maxRateLimitClients = 100_000
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	refill := time.Duration(float64(burst) / rps * float64(time.Second))
+	return &rateLimiter{
+		rps:      rate.Limit(rps),
+		burst:    burst,
+		idle:     max(refill, time.Minute),
+		clients:  map[string]*clientLimiter{},
+		verified: map[string]time.Time{},
+	}
+}
+
+// reserve takes a token for key, returning how long the client must wait
+// if none was available.
+func (l *rateLimiter) reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		evictOne(l.clients)
+		c = &clientLimiter{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	r := c.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return l.idle
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		// we won't wait for it, so give the token back.
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// sweep forgets idle clients and credentials, at most once per idle period.
+// l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) <= l.idle {
+		return
+	}
+	for k, c := range l.clients {
+		if now.Sub(c.lastSeen) > l.idle {
+			delete(l.clients, k)
+		}
+	}
+	for k, seen := range l.verified {
+		if now.Sub(seen) > l.idle {
+			delete(l.verified, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// evictOne makes room in m if it's full.
+func evictOne[V any](m map[string]V) {
+	if len(m) < maxRateLimitClients {
+		return
+	}
+	for k := range m {
+		delete(m, k)
+		return
+	}
+}
+
+// key identifies the client behind r for rate limiting: its credentials once
+// the upstream has accepted them, or else its IP. Made-up credentials cost
+// nothing, so keying on them unverified would hand out a fresh bucket per
+// request.
+func (l *rateLimiter) key(r *http.Request) string {
+	if cred := credentialKey(r); cred != "" {
+		l.mu.Lock()
+		_, ok := l.verified[cred]
+		l.mu.Unlock()
+		if ok {
+			return cred
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// verify records that the upstream accepted cred.
+func (l *rateLimiter) verify(cred string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.verified[cred]; !ok {
+		evictOne(l.verified)
+	}
+	l.verified[cred] = time.Now()
+}
+
+// credentialKey identifies the credentials r carries, hashed so they aren't
+// kept in memory, or is empty if it has none.
+func credentialKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(auth))
+	return "key:" + hex.EncodeToString(sum[:16])
+}
+
+// requestClientKey identifies the client behind r: its credentials if it sent
+// any, or else its IP.
+func requestClientKey(r *http.Request) string {
+	if cred := credentialKey(r); cred != "" {
+		return cred
+	}
+	return "ip:" + clientIP(r)
+}
+
+type credentialCheckKey struct{}
+
+// credentialCheck asks the proxy to tell limiter if the upstream accepts the
+// client's credentials; see checkCredentials.
+type credentialCheck struct {
+	cred    string
+	limiter *rateLimiter
+}
+
+// checkCredentials verifies the client's credentials with the rate limiter
+// that asked, if resp shows the upstream accepted them, as opposed to a key the
+// proxy injected in their place.
+func checkCredentials(resp *http.Response) {
+	check, _ := resp.Request.Context().Value(credentialCheckKey{}).(credentialCheck)
+	if check.limiter == nil || credentialKey(resp.Request) != check.cred {
+		return
+	}
+	if !isAuthFailure(resp) && resp.StatusCode < http.StatusInternalServerError {
+		check.limiter.verify(check.cred)
+	}
+}
+
+// rateLimit rejects requests over the client's rate with a 429 before they
+// reach the upstream, telling it when to retry.
+func rateLimit(l *rateLimiter) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := l.key(r)
+			if wait := l.reserve(key); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, slow down")
+				return
+			}
+			if cred := credentialKey(r); cred != "" && cred != key {
+				r = r.WithContext(context.WithValue(r.Context(), credentialCheckKey{}, credentialCheck{cred: cred, limiter: l}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
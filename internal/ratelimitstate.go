@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitState is what a rateLimiter saves to Config.RateLimitStateFile.
+type rateLimitState struct {
+	SavedAt  time.Time              `json:"saved_at"`
+	Clients  map[string]clientState `json:"clients"`
+	Verified map[string]time.Time   `json:"verified"`
+}
+
+type clientState struct {
+	Tokens   float64   `json:"tokens"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// rateLimiterFor returns the rate limiter cfg asks for, restored from
+// RateLimitStateFile if there's one, or nil if rate limiting is off.
+func rateLimiterFor(cfg *Config) *rateLimiter {
+	if cfg.RateLimit <= 0 {
+		return nil
+	}
+	l := newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst)
+	if cfg.RateLimitStateFile != "" {
+		if err := l.restore(cfg.RateLimitStateFile); err != nil {
+			cfg.Logger.Printf("not restoring rate limits: %s", err)
+		}
+	}
+	return l
+}
+
+// save writes the limiter's clients and verified credentials to path.
+func (l *rateLimiter) save(path string) error {
+	l.mu.Lock()
+	now := time.Now()
+	state := rateLimitState{
+		SavedAt:  now,
+		Clients:  make(map[string]clientState, len(l.clients)),
+		Verified: maps.Clone(l.verified),
+	}
+	for k, c := range l.clients {
+		state.Clients[k] = clientState{Tokens: c.limiter.TokensAt(now), LastSeen: c.lastSeen}
+	}
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// written aside and renamed into place, so a crash mid-write can't leave
+	// a truncated file behind.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restore loads the state save wrote to path, if it exists. Buckets carry on
+// refilling from when they were saved, as if the proxy had never stopped.
+func (l *rateLimiter) restore(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state rateLimitState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range state.Clients {
+		// sweep would have forgotten it by now anyway.
+		if now.Sub(c.LastSeen) > l.idle {
+			continue
+		}
+		evictOne(l.clients)
+		limiter := rate.NewLimiter(l.rps, l.burst)
+		// rounded up, so a restart never hands out a token the client didn't have.
+		if spent := int(math.Ceil(float64(l.burst) - c.Tokens)); spent > 0 {
+			limiter.ReserveN(state.SavedAt, min(spent, l.burst))
+		}
+		l.clients[k] = &clientLimiter{limiter: limiter, lastSeen: c.LastSeen}
+	}
+	for k, seen := range state.Verified {
+		if now.Sub(seen) > l.idle {
+			continue
+		}
+		evictOne(l.verified)
+		l.verified[k] = seen
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics stops a panic in the proxy or the middleware beneath it from
+// taking down the connection silently. The stack is logged, and the client
+// gets a 500 with a JSON body if nothing was written yet. If the response had
+// already started, what was written is flushed and the connection aborted,
+// so the client can't mistake a partial body for a full one.
+func recoverPanics(cfg *Config) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				// ReverseProxy aborts failed streams this way on purpose; let net/http handle it.
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+
+				cfg.Logger.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				if rec.status == 0 {
+					writeJSONError(w, http.StatusInternalServerError, "internal_error", "the proxy failed to handle the request")
+					return
+				}
+				rec.Flush()
+				panic(http.ErrAbortHandler)
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
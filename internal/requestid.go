@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader is the header carrying the request ID, unless changed with
+// WithRequestIDHeader.
+const RequestIDHeader = "X-Request-Id"
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// normalizeRequestID ensures at most one request ID is forwarded. When a
+// client sends several (as repeated headers or a comma-separated list), the
+// first is kept, or the request is rejected with 400 if so configured.
+// With WithRequestID, requests without one are given a new ID here, so even
+// requests that fail before reaching the upstream have one.
+func normalizeRequestID(cfg *Config) middleware {
+	header := cfg.RequestIDHeader
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ids []string
+			for _, v := range r.Header.Values(header) {
+				for _, id := range strings.Split(v, ",") {
+					if id = strings.TrimSpace(id); id != "" {
+						ids = append(ids, id)
+					}
+				}
+			}
+
+			if len(ids) > 1 {
+				if cfg.RejectDuplicateRequestID {
+					http.Error(w, "multiple "+header+" values", http.StatusBadRequest)
+					return
+				}
+				cfg.Logger.Printf("normalized %d %s values to %q", len(ids), header, ids[0])
+			}
+			if len(ids) > 0 {
+				r.Header.Set(header, ids[0])
+			} else if cfg.RequestID {
+				r.Header.Set(header, newRequestID())
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
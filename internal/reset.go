@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// isConnReset reports whether err looks like the upstream dropping the connection.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isIdempotent reports whether req can safely be sent again.
+// Requests with a body are excluded, since the body has already been consumed.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// resetRetryTransport retries idempotent requests when the upstream resets
+// the connection before sending a response. Nothing has been written to the
+// client at that point, so the retry is invisible to it.
+type resetRetryTransport struct {
+	next    http.RoundTripper
+	retries int
+	limiter *retryLimiter
+	logger  *log.Logger
+}
+
+func (t *resetRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	for i := 0; i < t.retries && err != nil && isConnReset(err) && isIdempotent(req) && t.limiter.allow(req); i++ {
+		t.logger.Printf("upstream reset connection for %s %s, retrying: %s", req.Method, req.URL, err)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// resetDetectingBody logs when the upstream connection fails while the
+// response body is being copied to the client. By then headers have been
+// sent, so the best we can do is make the failure visible; ReverseProxy
+// aborts the client connection so it doesn't mistake a partial body for a
+// full one, rather than leaving it waiting for bytes that will never come.
+type resetDetectingBody struct {
+	io.ReadCloser
+	req    *http.Request
+	logger *log.Logger
+	// declared is the upstream Content-Length, or -1 if unknown.
+	declared int64
+	read     int64
+	failed   bool
+	// failures counts failures by reason, if metrics are enabled.
+	failures *prometheus.CounterVec
+}
+
+func (b *resetDetectingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// a canceled context means the client went away, which isn't the upstream's fault.
+	if err != nil && err != io.EOF && !b.failed && b.req.Context().Err() == nil {
+		b.failed = true
+		reason := "failed"
+		if err == io.ErrUnexpectedEOF && b.declared >= 0 {
+			// a clean close before the declared length: the upstream lied about Content-Length.
+			reason = "short"
+			b.logger.Printf("upstream Content-Length mismatch for %s %s: declared %d bytes, got %d", b.req.Method, b.req.URL, b.declared, b.read)
+		} else {
+			b.logger.Printf("upstream connection failed mid-body for %s %s after %d bytes: %s", b.req.Method, b.req.URL, b.read, err)
+		}
+		if b.failures != nil {
+			b.failures.WithLabelValues(reason).Inc()
+		}
+	}
+	return n, err
+}
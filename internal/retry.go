@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ProxyRetriesHeader reports how many times the proxy retried a request
+// because the upstream was unavailable, when it retried at all.
+const ProxyRetriesHeader = "X-Proxy-Retries"
+
+// IdempotencyKeyHeader marks a request as safe to retry regardless of method.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// retryTransport retries requests that failed because the upstream was
+// briefly unavailable: connection refused, timeouts, and 502/503/504
+// responses. Delays grow exponentially from base, with jitter so clients
+// retrying together don't hit a recovering upstream in lockstep.
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	base     time.Duration
+	limiter  *retryLimiter
+	logger   *log.Logger
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	retries := 0
+	for ; retries+1 < t.attempts && shouldRetry(req, resp, err); retries++ {
+		if !t.limiter.allow(req) {
+			break
+		}
+		retry, rerr := rewind(req)
+		if rerr != nil {
+			t.logger.Printf("can't retry %s %s: %s", req.Method, req.URL, rerr)
+			break
+		}
+
+		t.logger.Printf("upstream unavailable for %s %s, retrying: %s", req.Method, req.URL, describe(resp, err))
+		if resp != nil {
+			// drain so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff(t.base, retries))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		req = retry
+		resp, err = t.next.RoundTrip(req)
+	}
+	if resp != nil && retries > 0 {
+		resp.Header.Set(ProxyRetriesHeader, strconv.Itoa(retries))
+	}
+	return resp, err
+}
+
+// shouldRetry reports whether the outcome of req is worth another attempt.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// the client went away or the request deadline passed; more attempts won't help.
+	if req.Context().Err() != nil || !isRetryable(req) {
+		return false
+	}
+	if err != nil {
+		var ne net.Error
+		return errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &ne) && ne.Timeout())
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryable reports whether req may be sent again: GET/HEAD, requests
+// carrying an Idempotency-Key and those whose body was buffered for retries,
+// as long as any body can be replayed.
+func isRetryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Header.Get(IdempotencyKeyHeader) == "" && !bodyBuffered(req.Context()) {
+		return false
+	}
+	return replayable(req)
+}
+
+// rewind returns a copy of req with a fresh body for another attempt.
+func rewind(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// backoff returns the delay before retry n (from 0): base doubled n times,
+// with up to half of it replaced by jitter.
+func backoff(base time.Duration, n int) time.Duration {
+	d := base << n
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func describe(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
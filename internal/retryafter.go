@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minRetryAfterWait is the least we wait between 429s, so a Retry-After
+	// of 0 or a date in the past can't have us hammering the upstream.
+	minRetryAfterWait = 100 * time.Millisecond
+	// maxRetryAfterAttempts caps the retries per request, however short the waits.
+	maxRetryAfterAttempts = 5
+)
+
+// retryAfterTransport waits out 429 responses for as long as the upstream's
+// Retry-After asks, then tries again. The total wait per request is capped
+// at maxWait, and the retries at maxRetryAfterAttempts; past either, the 429
+// is returned to the client as-is.
+type retryAfterTransport struct {
+	next    http.RoundTripper
+	maxWait time.Duration
+	limiter *retryLimiter
+	logger  *log.Logger
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		wait = max(wait, minRetryAfterWait)
+		if !ok || attempt >= maxRetryAfterAttempts || waited+wait > t.maxWait || !replayable(req) || !t.limiter.allow(req) {
+			return resp, nil
+		}
+		retry, err := rewind(req)
+		if err != nil {
+			return resp, nil
+		}
+
+		t.logger.Printf("upstream rate limited %s %s, retrying after %s", req.Method, req.URL, wait)
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		waited += wait
+		req = retry
+	}
+}
+
+// replayable reports whether req's body, if any, can be sent again.
+// A 429 means the upstream didn't process the request, so any method is safe.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// parseRetryAfter parses a Retry-After value in either delay-seconds or
+// HTTP-date form (RFC 9110 10.2.3) into a wait relative to now.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		// anything this large is past any sane cap; avoid overflowing Duration.
+		if secs > int64(24*time.Hour/time.Second) {
+			secs = int64(24 * time.Hour / time.Second)
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if wait := at.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
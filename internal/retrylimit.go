@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryLimiter caps how many retries each client may trigger within a window,
+// so a single client can't drive unbounded retries against the upstream.
+type retryLimiter struct {
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*retryWindow
+}
+
+type retryWindow struct {
+	start time.Time
+	count int
+}
+
+func newRetryLimiter(max int, window time.Duration) *retryLimiter {
+	if max <= 0 || window <= 0 {
+		return nil
+	}
+	return &retryLimiter{
+		max:     max,
+		window:  window,
+		clients: map[string]*retryWindow{},
+	}
+}
+
+// allow reports whether req's client may retry, consuming one retry if so.
+// A nil limiter allows everything.
+func (l *retryLimiter) allow(req *http.Request) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	client := clientFromContext(req.Context())
+
+	w, ok := l.clients[client]
+	if !ok || now.Sub(w.start) > l.window {
+		// opportunistically drop expired windows so idle clients don't accumulate.
+		for c, w := range l.clients {
+			if now.Sub(w.start) > l.window {
+				delete(l.clients, c)
+			}
+		}
+		w = &retryWindow{start: now}
+		l.clients[client] = w
+	}
+
+	if w.count >= l.max {
+		return false
+	}
+	w.count++
+	return true
+}
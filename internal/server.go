@@ -2,57 +2,282 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Server wrapper http.Server and net.Listener to make access to
 // certain internal fields more easily accessible.
 type Server struct {
-	srv      *http.Server
-	listener net.Listener
+	srv       *http.Server
+	listeners []*pausableListener
+	cfg       *Config
+
+	// tls is set once ServeTLS starts, so URL reports https.
+	tls atomic.Bool
+
+	// active counts requests currently being handled, for drain reporting.
+	active atomic.Int64
+
+	// admin serves the debug endpoints on Config.AdminAddress, if set.
+	admin         *http.Server
+	adminListener net.Listener
+
+	// limiter is the rate limiter, if enabled, for saving on Shutdown.
+	limiter *rateLimiter
 }
 
 // NewServer creates an http server with a reverse proxy handler.
 // We split the live server and proxy handler for testability.
-func NewServer(target *url.URL) *Server {
-	proxy := NewProxy(target)
+// See NewHandler for using the handler with your own server.
+// Unlike NewHandler, it also serves a health endpoint and, if enabled,
+// metrics and debug endpoints; see WithHealthPath, WithMetrics and
+// WithDebugEndpoints.
+func NewServer(target *url.URL, opts ...Option) *Server {
+	cfg := NewConfig(opts...)
+	// kept, so Shutdown can save its state.
+	limiter := rateLimiterFor(cfg)
+	handler := wrap(NewProxy(target, opts...), cfg, limiter)
+
+	local := map[string]http.Handler{}
+	for path, resp := range cfg.StaticResponses {
+		local[path] = resp
+	}
+	if cfg.HealthPath != "" {
+		local[cfg.HealthPath] = healthCheck(target, cfg)
+	}
+	if cfg.MetricsRegistry != nil {
+		local[MetricsPath] = metricsHandler(cfg.MetricsRegistry)
+	}
+	if len(local) > 0 {
+		handler = serveLocal(handler, local)
+	}
 
-	srv := &http.Server{
-		Handler:           proxy,
-		ReadTimeout:       5 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadHeaderTimeout: 2 * time.Second,
+	s := &Server{
+		cfg:     cfg,
+		limiter: limiter,
 	}
 
-	return &Server{
-		srv: srv,
+	if cfg.DebugEndpoints {
+		if cfg.AdminAddress != "" {
+			// kept off the client-facing listeners entirely.
+			handler = serveDebug(handler, nil)
+			s.admin = &http.Server{
+				Handler:           restrictClients(debugHandler(), cfg),
+				ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+				ErrorLog:          cfg.Logger,
+			}
+		} else {
+			handler = serveDebug(handler, debugHandler())
+		}
 	}
+
+	s.srv = &http.Server{
+		Handler:           s.countActive(restrictClients(handler, cfg)),
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ErrorLog:          cfg.Logger,
+	}
+	if cfg.WatchdogTimeout > 0 {
+		s.srv.ConnContext = withConn
+	}
+
+	return s
+}
+
+// NewValidatedServer is like NewServer, but first checks target and opts,
+// returning an error rather than a server that fails on its first request.
+func NewValidatedServer(target *url.URL, opts ...Option) (*Server, error) {
+	if err := errors.Join(ValidateTarget(target), NewConfig(opts...).Validate()); err != nil {
+		return nil, err
+	}
+	return NewServer(target, opts...), nil
+}
+
+// countActive tracks the number of in-flight requests.
+func (s *Server) countActive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.active.Add(1)
+		defer s.active.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ActiveRequests returns the number of requests currently in flight.
+func (s *Server) ActiveRequests() int64 {
+	return s.active.Load()
 }
 
 // Listen creates a listener on the given address.
-// It stores the listener for later calls to Serve,
+// address may be a comma-separated list, in which case a listener is
+// created for each and the same handler is served on all of them.
+// An address of the form unix:///path/to/socket listens on a Unix domain
+// socket instead of TCP; see listenUnix.
+// It stores the listeners for later calls to Serve,
 // and to allow programmatic retrieval of the listening address
 // for cases where it is randomized (e.g. ':0').
 func (s *Server) Listen(address string) error {
-	listener, err := net.Listen("tcp", address)
+	var listeners []*pausableListener
+	for _, addr := range strings.Split(address, ",") {
+		addr := strings.TrimSpace(addr)
+		var listener net.Listener
+		var listen func() (net.Listener, error)
+		var err error
+		if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+			// resuming after Pause recreates the socket file, permissions and all.
+			listen = func() (net.Listener, error) { return listenUnix(path) }
+			listener, err = listen()
+		} else {
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to create listener: %s", err)
+		}
+		listeners = append(listeners, newPausableListener(listener, listen))
+	}
+
+	if s.admin != nil {
+		listener, err := net.Listen("tcp", s.cfg.AdminAddress)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to create admin listener: %s", err)
+		}
+		s.adminListener = listener
+	}
+
+	s.listeners = listeners
+	return nil
+}
+
+// unixScheme prefixes Unix domain socket addresses given to Listen.
+const unixScheme = "unix://"
+
+// listenUnix listens on a Unix domain socket at path, readable and writable
+// by its owner and group only. A socket file left behind by a process that
+// didn't shut down cleanly is removed first, but not one still in use.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
 	if err != nil {
-		return fmt.Errorf("failed to create listener: %s", err)
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %s", err)
+	}
+	return listener, nil
+}
+
+// Pause stops accepting new connections on every listener, without shutting
+// down. New connections are refused while existing ones keep being served.
+// It's useful for load shedding; call Resume to accept connections again.
+func (s *Server) Pause() error {
+	for _, l := range s.listeners {
+		if err := l.Pause(); err != nil {
+			return fmt.Errorf("failed to pause listener %s: %s", l.Addr(), err)
+		}
+	}
+	return nil
+}
+
+// Resume starts accepting new connections again after Pause.
+func (s *Server) Resume() error {
+	for _, l := range s.listeners {
+		if err := l.Resume(); err != nil {
+			return fmt.Errorf("failed to resume listener %s: %s", l.Addr(), err)
+		}
 	}
-	s.listener = listener
 	return nil
 }
 
-// Serve starts the http server with the existing listener.
+// ListenerFiles returns duplicated file descriptors for every listener, in
+// the order given to Listen, so a supervisor can pass them to a replacement
+// process (e.g. as ExtraFiles, rebuilt with net.FileListener) and restart
+// without dropping the sockets. The caller owns and must close the files.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	files := make([]*os.File, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("failed to duplicate listener %s: %s", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Serve starts the http server with the existing listeners.
+// It returns as soon as any listener stops serving; if that was due to an
+// error rather than shutdown, the remaining listeners are closed too.
 func (s *Server) Serve() error {
-	if s.listener == nil {
+	return s.serve(s.srv.Serve)
+}
+
+// ServeTLS is like Serve, but terminates TLS on every listener using the
+// given certificate and key files. HTTP/2 is negotiated automatically.
+func (s *Server) ServeTLS(certFile, keyFile string) error {
+	s.tls.Store(true)
+	return s.serve(func(l net.Listener) error {
+		return s.srv.ServeTLS(l, certFile, keyFile)
+	})
+}
+
+func (s *Server) serve(serve func(net.Listener) error) error {
+	if len(s.listeners) == 0 {
 		return fmt.Errorf("must call Listen() before Serve()")
 	}
-	return s.srv.Serve(s.listener)
+
+	if s.adminListener != nil {
+		go func() {
+			if err := s.admin.Serve(s.adminListener); err != http.ErrServerClosed {
+				s.cfg.Logger.Printf("admin server stopped: %s", err)
+			}
+		}()
+	}
+
+	errs := make(chan error, len(s.listeners))
+	for _, listener := range s.listeners {
+		go func(l net.Listener) {
+			errs <- serve(l)
+		}(listener)
+	}
+
+	err := <-errs
+	if err != http.ErrServerClosed {
+		s.srv.Close()
+		if s.admin != nil {
+			s.admin.Close()
+		}
+	}
+	return err
 }
 
 // ListenAndServe is a convenience method for Listen() and Serve().
@@ -64,18 +289,104 @@ func (s *Server) ListenAndServe(address string) error {
 	if err := s.Listen(address); err != nil {
 		return err
 	}
-	return s.srv.Serve(s.listener)
+	return s.Serve()
+}
+
+// ListenAndServeTLS is a convenience method for Listen() and ServeTLS().
+func (s *Server) ListenAndServeTLS(address, certFile, keyFile string) error {
+	if err := s.Listen(address); err != nil {
+		return err
+	}
+	return s.ServeTLS(certFile, keyFile)
 }
 
-// Shutdown cleanly shuts down the server. It's primarily used for testing.
+// Shutdown cleanly shuts down the server, waiting for in-flight requests to
+// drain until ctx is done. Without a deadline on ctx, it waits at most 10s.
+// While draining, it periodically logs how many requests remain in flight.
+// Once drained, it saves the rate limiter's state if WithRateLimitStateFile
+// is set.
 func (s *Server) Shutdown(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	return s.srv.Shutdown(ctx)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.reportDrain(done)
+	}()
+	defer wg.Wait()
+	defer close(done)
+
+	if s.admin != nil {
+		// nothing there worth draining for.
+		s.admin.Close()
+	}
+	err := s.srv.Shutdown(ctx)
+	if s.limiter != nil && s.cfg.RateLimitStateFile != "" {
+		if saveErr := s.limiter.save(s.cfg.RateLimitStateFile); saveErr != nil {
+			err = errors.Join(err, fmt.Errorf("saving rate limits: %s", saveErr))
+		}
+	}
+	return err
+}
+
+// reportDrain logs the active request count every DrainLogInterval until done is closed.
+func (s *Server) reportDrain(done <-chan struct{}) {
+	if s.cfg.DrainLogInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.DrainLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if n := s.ActiveRequests(); n > 0 {
+				s.cfg.Logger.Printf("shutdown: draining, %d active requests remaining", n)
+			}
+		}
+	}
 }
 
 // URL returns the server listening URL when a random port is used.
 // This allows programmatic randomization of ports during testing.
+// With multiple listeners, it returns the URL of the first; see URLs.
 func (s *Server) URL() string {
-	return fmt.Sprintf("http://%s", s.listener.Addr().String())
+	return s.URLs()[0]
+}
+
+// AdminURL returns the URL of the admin listener serving the debug
+// endpoints, or "" without one; see WithAdminAddress.
+func (s *Server) AdminURL() string {
+	if s.adminListener == nil {
+		return ""
+	}
+	return "http://" + s.adminListener.Addr().String()
+}
+
+// URLs returns the listening URL of every listener, in the order given to Listen.
+// The scheme is https once ServeTLS has been called. Unix domain sockets
+// are returned as given to Listen, e.g. unix:///run/proxy.sock.
+func (s *Server) URLs() []string {
+	scheme := "http"
+	if s.tls.Load() {
+		scheme = "https"
+	}
+	urls := make([]string, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		if l.Addr().Network() == "unix" {
+			urls = append(urls, unixScheme+l.Addr().String())
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("%s://%s", scheme, l.Addr().String()))
+	}
+	return urls
 }
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShadowIDHeader carries an ID shared by a shadowed request and its shadow
+// copy, to both upstreams. The access log and shadow log entries include it
+// as shadow_id, so the two can be compared.
+const ShadowIDHeader = "X-Shadow-Id"
+
+const (
+	// maxShadowsInFlight caps the shadow requests running at once. Past it, new
+	// ones are dropped rather than piling up behind a slow shadow target.
+	maxShadowsInFlight = 64
+	// maxShadowLag caps how far a shadow may fall behind the primary request
+	// reading a body they share through a tee, and maxShadowStall how long the
+	// primary may be held up waiting for it. Past both, the shadow is cut off.
+	maxShadowLag   = 1 << 20
+	maxShadowStall = 250 * time.Millisecond
+)
+
+// ShadowRule shadows Fraction of the requests matching every attribute it
+// sets. Unset attributes match anything.
+type ShadowRule struct {
+	// PathPrefix matches request paths starting with it.
+	PathPrefix string
+	// Header matches requests carrying it, with a value of HeaderValue if
+	// that's set too.
+	Header      string
+	HeaderValue string
+	// ClientCIDRs match clients, resolved behind any trusted proxies, in one
+	// of these networks.
+	ClientCIDRs []string
+	Fraction    float64
+}
+
+// shadowSampler returns the fraction of requests like r to shadow: that of
+// the first of cfg.ShadowRules r matches, or none if it matches none of them.
+// Without rules, it's ShadowFraction for every request.
+func shadowSampler(cfg *Config) func(r *http.Request) float64 {
+	if len(cfg.ShadowRules) == 0 {
+		return func(*http.Request) float64 { return cfg.ShadowFraction }
+	}
+
+	type rule struct {
+		ShadowRule
+		clients cidrSet
+		invalid bool
+	}
+	rules := make([]rule, len(cfg.ShadowRules))
+	for i, sr := range cfg.ShadowRules {
+		clients, err := parseCIDRs(sr.ClientCIDRs)
+		if err != nil {
+			// a rule meant for some clients mustn't shadow everyone's requests.
+			cfg.Logger.Printf("disabling shadow rule %d: invalid client CIDRs: %s", i, err)
+		}
+		rules[i] = rule{ShadowRule: sr, clients: clients, invalid: err != nil}
+	}
+
+	return func(r *http.Request) float64 {
+		for _, rule := range rules {
+			switch {
+			case rule.invalid:
+			case !strings.HasPrefix(r.URL.Path, rule.PathPrefix):
+			case rule.Header != "" && len(r.Header.Values(rule.Header)) == 0:
+			case rule.HeaderValue != "" && r.Header.Get(rule.Header) != rule.HeaderValue:
+			case len(rule.ClientCIDRs) > 0 && !rule.clients.contains(clientIP(r)):
+			default:
+				return rule.Fraction
+			}
+		}
+		return 0
+	}
+}
+
+// shadow copies a sampled fraction of requests to the shadow target in the
+// background, discarding its responses. The primary request never waits on
+// the copy. Bodies bufferBody buffered are copied whole; others are teed to
+// the shadow as the primary request reads them, see teeBody. Each copy's
+// outcome is logged at debug level.
+func shadow(cfg *Config) middleware {
+	// copies go through a proxy of their own, so they get the same header and
+	// query stripping and credentials as the primary request, but none of the
+	// routing, retries, metrics or logging meant for the primary upstream.
+	sc := *cfg
+	sc.Balancer = nil
+	sc.Canary = nil
+	sc.UpstreamTokenSecret = nil
+	sc.MetricsRegistry = nil
+	sc.RetryAttempts = 0
+	sc.ResetRetries = 0
+	sc.RespectRetryAfter = false
+	sc.SummaryTrailers = nil
+	sc.LogHeaderDiffs = false
+	sc.ErrorBodyLogLimit = 0
+	// whatever the proxy would log goes to the access log at debug level too.
+	sc.Logger = log.New(io.Discard, "", 0)
+	if cfg.AccessLog != nil {
+		sc.Logger = slog.NewLogLogger(cfg.AccessLog.Handler(), slog.LevelDebug)
+	}
+	sc.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logShadowFailure(cfg.AccessLog, r, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	proxy := newProxy(cfg.Shadow, &sc)
+
+	slots := make(chan struct{}, maxShadowsInFlight)
+	fraction := shadowSampler(cfg)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// only ever one the proxy set itself.
+			r.Header.Del(ShadowIDHeader)
+			if rand.Float64() < fraction(r) {
+				select {
+				case slots <- struct{}{}:
+					r.Header.Set(ShadowIDHeader, newRequestID())
+					if copied, ok := shadowRequest(r, cfg.ShadowTimeout); ok {
+						go func() {
+							defer func() { <-slots }()
+							sendShadow(proxy, copied, cfg)
+						}()
+					} else {
+						<-slots
+						r.Header.Del(ShadowIDHeader)
+					}
+				default:
+					logShadowFailure(cfg.AccessLog, r, errShadowsFull)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// shadowCopy is a copy of a request for the shadow, with its own timeout.
+type shadowCopy struct {
+	*http.Request
+	cancel context.CancelFunc
+}
+
+// shadowRequest copies r for the shadow, or reports false if its body can't be
+// copied. Unbuffered bodies are teed, replacing r.Body.
+func shadowRequest(r *http.Request, timeout time.Duration) (shadowCopy, bool) {
+	body := io.ReadCloser(http.NoBody)
+	switch {
+	case r.Body == nil || r.Body == http.NoBody:
+	case bodyBuffered(r.Context()) && r.GetBody != nil:
+		var err error
+		if body, err = r.GetBody(); err != nil {
+			return shadowCopy{}, false
+		}
+	default:
+		r.Body, body = teeBody(r.Body, maxShadowLag, maxShadowStall)
+	}
+
+	// the copy mustn't be cancelled along with the primary request.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	out := r.Clone(ctx)
+	out.Body = body
+	return shadowCopy{Request: out, cancel: cancel}, true
+}
+
+// sendShadow proxies req to the shadow and throws away the response.
+func sendShadow(proxy http.Handler, req shadowCopy, cfg *Config) {
+	defer req.cancel()
+	// stops a teed body buffering for a shadow that never read it.
+	defer req.Body.Close()
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: discardWriter{header: http.Header{}}}
+	defer func() {
+		// ReverseProxy aborts with a panic when a response body fails midway,
+		// which nothing above this goroutine would recover.
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				cfg.Logger.Printf("panic shadowing %s %s: %v\n%s", req.Method, req.URL.Path, v, debug.Stack())
+				return
+			}
+			logShadowFailure(cfg.AccessLog, req.Request, errShadowAborted)
+		}
+	}()
+	proxy.ServeHTTP(rec, req.Request)
+
+	if cfg.AccessLog != nil {
+		cfg.AccessLog.LogAttrs(req.Context(), slog.LevelDebug, "shadow request",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", rec.code()),
+			slog.Int64("bytes", rec.written),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("shadow_id", req.Header.Get(ShadowIDHeader)),
+		)
+	}
+}
+
+var (
+	errShadowsFull   = errors.New("too many shadow requests in flight")
+	errShadowAborted = errors.New("shadow response aborted")
+	errShadowBehind  = errors.New("shadow fell too far behind reading the request body")
+	errPrimaryClosed = errors.New("request body closed before it was read to the end")
+)
+
+// logShadowFailure logs err at debug level; the shadow isn't serving anyone.
+func logShadowFailure(logger *slog.Logger, r *http.Request, err error) {
+	if logger == nil {
+		return
+	}
+	logger.LogAttrs(r.Context(), slog.LevelDebug, "shadow request failed",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("error", err.Error()),
+		slog.String("shadow_id", r.Header.Get(ShadowIDHeader)),
+	)
+}
+
+// teeBody splits src in two: primary reads src as usual, and whatever it
+// reads is passed on to shadow through a buffer of up to lag bytes. When the
+// buffer is full, the primary waits for the shadow to catch up, but for no
+// more than stall in all; a shadow that's still behind is then cut off with
+// errShadowBehind. The shadow sees the end of the body when the primary does,
+// and errPrimaryClosed if the primary stops short.
+func teeBody(src io.ReadCloser, lag int, stall time.Duration) (primary, shadow io.ReadCloser) {
+	t := &tee{src: src, lag: lag, stall: stall, changed: make(chan struct{})}
+	return teePrimary{t}, teeShadow{t}
+}
+
+type tee struct {
+	src   io.ReadCloser
+	lag   int
+	stall time.Duration
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// err ends the shadow's reads once buf is drained.
+	err error
+	// shadowClosed stops buffering for a shadow that's gone.
+	shadowClosed bool
+	// changed is closed, and replaced, whenever any of the above changes.
+	changed chan struct{}
+}
+
+func (t *tee) broadcast() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// wait releases t.mu until something changes, reporting false if timeout
+// fires first.
+func (t *tee) wait(timeout <-chan time.Time) bool {
+	changed := t.changed
+	t.mu.Unlock()
+	defer t.mu.Lock()
+	select {
+	case <-changed:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+type teePrimary struct{ *tee }
+
+func (p teePrimary) Read(b []byte) (int, error) {
+	n, err := p.src.Read(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var timeout <-chan time.Time
+	for p.buf.Len()+n > p.lag && !p.shadowClosed && p.err == nil && p.stall > 0 {
+		if timeout == nil {
+			timer := time.NewTimer(p.stall)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		start := time.Now()
+		if !p.wait(timeout) {
+			p.stall = 0
+			break
+		}
+		p.stall -= time.Since(start)
+	}
+	if p.shadowClosed || p.err != nil {
+		return n, err
+	}
+	if p.buf.Len()+n > p.lag {
+		p.buf.Reset()
+		p.err = errShadowBehind
+	} else {
+		p.buf.Write(b[:n])
+		if err != nil {
+			p.err = err
+		}
+	}
+	p.broadcast()
+	return n, err
+}
+
+func (p teePrimary) Close() error {
+	err := p.src.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = errPrimaryClosed
+		p.broadcast()
+	}
+	return err
+}
+
+type teeShadow struct{ *tee }
+
+func (s teeShadow) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && s.err == nil && !s.shadowClosed {
+		s.wait(nil)
+	}
+	if s.shadowClosed {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	if s.buf.Len() > 0 && s.err != errShadowBehind {
+		n, _ := s.buf.Read(b)
+		s.broadcast()
+		return n, nil
+	}
+	return 0, s.err
+}
+
+// Close is called by the shadow's transport, including when its request is
+// cancelled or times out, which wakes up any Read waiting on the primary.
+func (s teeShadow) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.shadowClosed {
+		s.shadowClosed = true
+		s.buf.Reset()
+		s.broadcast()
+	}
+	return nil
+}
+
+// discardWriter is a ResponseWriter that throws away whatever it's given.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+func (w discardWriter) Flush()                      {}
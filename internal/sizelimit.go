@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// errResponseTooLarge is reported when an upstream response exceeds
+// Config.MaxResponseBytes.
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// limitRequestBody rejects request bodies over n bytes with a 413: up front
+// when the Content-Length says so, or else once reading passes the limit.
+func limitRequestBody(n int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("the request body exceeds %d bytes", n))
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyReadError answers a request whose body couldn't be read, with a 413
+// if it was cut off by limitRequestBody.
+func bodyReadError(w http.ResponseWriter, err error) {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("the request body exceeds %d bytes", mbe.Limit))
+		return
+	}
+	http.Error(w, "failed to read request body", http.StatusBadRequest)
+}
+
+// limitResponseBody fails responses over n bytes. A Content-Length over the
+// limit fails before anything is sent to the client; otherwise the body is
+// streamed as usual and cut off once it passes the limit, aborting the
+// client connection so it can't mistake the partial body for a full one.
+func limitResponseBody(resp *http.Response, n int64) error {
+	if resp.ContentLength > n {
+		resp.Body.Close()
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", errResponseTooLarge, resp.ContentLength, n)
+	}
+	resp.Body = &maxBytesBody{ReadCloser: resp.Body, limit: n, remaining: n}
+	return nil
+}
+
+type maxBytesBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w: exceeds the limit of %d bytes", errResponseTooLarge, b.limit)
+	}
+	// read one byte past the limit to tell a body of exactly limit bytes from a longer one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = -1
+	return n, fmt.Errorf("%w: exceeds the limit of %d bytes", errResponseTooLarge, b.limit)
+}
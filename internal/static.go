@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// StaticResponse is a fixed response Server answers a path with itself,
+// e.g. /robots.txt, so crawlers probing the proxy never reach the upstream.
+type StaticResponse struct {
+	ContentType string
+	Body        string
+}
+
+func (s StaticResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", s.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.Body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(s.Body))
+	}
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requireTLS rejects requests that didn't originally arrive over HTTPS with 403.
+// When a trusted proxy (e.g. a TLS-terminating load balancer) sits in front of
+// us, the original scheme is taken from its X-Forwarded-Proto header; the header
+// is ignored from anyone else, so clients can't claim HTTPS themselves.
+func requireTLS(trusted cidrSet) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proto := "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+			if forwarded := forwardedProto(r.Header); forwarded != "" && trusted.contains(peerIP(r)) {
+				proto = forwarded
+			}
+
+			if proto != "https" {
+				http.Error(w, "HTTPS is required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedProto returns the scheme in the last X-Forwarded-Proto entry, the
+// one appended by the proxy that connected to us. Earlier entries may have come
+// from the client, as when a load balancer appends to the header.
+func forwardedProto(h http.Header) string {
+	values := h.Values("X-Forwarded-Proto")
+	if len(values) == 0 {
+		return ""
+	}
+	entries := strings.Split(values[len(values)-1], ",")
+	return strings.ToLower(strings.TrimSpace(entries[len(entries)-1]))
+}
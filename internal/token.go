@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies bearer tokens for authenticating to the upstream.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// RefreshingTokenSource fetches short-lived tokens from a token endpoint
+// and caches them until shortly before they expire.
+//
+// The endpoint is expected to answer a GET with an OAuth2-style JSON body:
+//
+//	{"access_token": "...", "expires_in": 3600}
+type RefreshingTokenSource struct {
+	// Endpoint is the URL tokens are fetched from.
+	Endpoint string
+	// Client is used to call Endpoint. Defaults to a client with a 10s timeout.
+	Client *http.Client
+	// EarlyExpiry refreshes the token this long before it actually expires,
+	// so in-flight requests don't race the expiry.
+	EarlyExpiry time.Duration
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewRefreshingTokenSource creates a token source for the given endpoint
+// which refreshes tokens 30 seconds before expiry.
+func NewRefreshingTokenSource(endpoint string) *RefreshingTokenSource {
+	return &RefreshingTokenSource{
+		Endpoint:    endpoint,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		EarlyExpiry: 30 * time.Second,
+	}
+}
+
+// Token returns the cached token, fetching a new one if it is missing
+// or about to expire.
+func (ts *RefreshingTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Add(ts.EarlyExpiry).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	token, expiry, err := ts.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	ts.token, ts.expiry = token, expiry
+	return token, nil
+}
+
+func (ts *RefreshingTokenSource) fetch(ctx context.Context) (string, time.Time, error) {
+	client := ts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.Endpoint, nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create token request: %s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to fetch token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to decode token response: %s", err)
+	}
+	if body.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token endpoint returned an empty access_token")
+	}
+
+	return body.AccessToken, time.Now().Add(time.Duration(body.ExpiresIn) * time.Second), nil
+}
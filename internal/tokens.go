@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultTokenFields are the JSON request fields holding prompt text in
+// Cohere's generate and chat APIs. Dots descend into objects; arrays are
+// traversed along the way.
+var DefaultTokenFields = []string{"prompt", "message", "preamble", "chat_history.message", "messages.content"}
+
+type promptTokensKey struct{}
+
+func withPromptTokens(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, promptTokensKey{}, n)
+}
+
+// promptTokensFromContext returns the approximate prompt tokens counted for a
+// request, and whether they were counted at all.
+func promptTokensFromContext(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(promptTokensKey{}).(int)
+	return n, ok
+}
+
+// maxTokenCountBytes caps the bodies countTokens buffers to parse. Larger
+// ones are streamed through uncounted.
+const maxTokenCountBytes = 8 << 20
+
+// countTokens logs an approximate prompt token count for JSON request bodies
+// and records it in the request context for cost estimation. The body is
+// buffered to be parsed, then rewound so it can still be forwarded upstream.
+// Bodies over maxTokenCountBytes aren't counted.
+func countTokens(cfg *Config) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" || r.Body == nil || r.Body == http.NoBody || r.ContentLength > maxTokenCountBytes {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxTokenCountBytes+1))
+			if err != nil {
+				r.Body.Close()
+				bodyReadError(w, err)
+				return
+			}
+			if len(body) > maxTokenCountBytes {
+				// put back what was read ahead of the rest.
+				r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+
+			var doc any
+			// malformed JSON is the upstream's to reject; just don't count it.
+			if err := json.Unmarshal(body, &doc); err == nil {
+				n := 0
+				for _, field := range cfg.TokenFields {
+					for _, text := range lookupStrings(doc, strings.Split(field, ".")) {
+						n += approxTokens(text)
+					}
+				}
+				cfg.Logger.Printf("request %s %s: ~%d prompt tokens", r.Method, r.URL.Path, n)
+				r = r.WithContext(withPromptTokens(r.Context(), n))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// lookupStrings returns the strings found at path in doc, descending through
+// arrays wherever they appear.
+func lookupStrings(doc any, path []string) []string {
+	switch v := doc.(type) {
+	case []any:
+		var out []string
+		for _, elem := range v {
+			out = append(out, lookupStrings(elem, path)...)
+		}
+		return out
+	case map[string]any:
+		if len(path) == 0 {
+			return nil
+		}
+		return lookupStrings(v[path[0]], path[1:])
+	case string:
+		if len(path) == 0 {
+			return []string{v}
+		}
+	}
+	return nil
+}
+
+// approxTokens estimates tokens with the usual rule of thumb of four
+// characters per token for English text. It's meant for budgeting, not
+// billing; the upstream's tokenizer is authoritative.
+func approxTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
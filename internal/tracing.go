@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/alexeldeib/cohere-reverse-proxy"
+
+// tracePropagator reads and writes the W3C traceparent and tracestate headers.
+var tracePropagator = propagation.TraceContext{}
+
+// tracing starts a server span for each request, continuing any trace the
+// client started. The span ends with the handler, however it returns.
+func tracing(tp trace.TracerProvider) middleware {
+	tracer := tp.Tracer(tracerName)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+				),
+			)
+			rec := &statusRecorder{ResponseWriter: w}
+			// deferred, so clients going away mid-stream still end the span.
+			defer func() {
+				status := rec.code()
+				span.SetAttributes(attribute.Int("http.response.status_code", status))
+				if status >= 500 {
+					span.SetStatus(codes.Error, http.StatusText(status))
+				}
+				span.End()
+			}()
+			next.ServeHTTP(rec, r.WithContext(ctx))
+		})
+	}
+}
+
+// injectTrace passes the request's span on to the upstream, replacing the
+// client's traceparent. Without a span, the client's is left as it was.
+func injectTrace(out *http.Request) {
+	if trace.SpanContextFromContext(out.Context()).IsValid() {
+		tracePropagator.Inject(out.Context(), propagation.HeaderCarrier(out.Header))
+	}
+}
+
+// traceResponse tells the client which trace its request was recorded in,
+// with a traceparent header naming the proxy's span, so client-side traces,
+// e.g. a browser's, can be joined up with the proxy's. Unless the span is
+// being recorded, the response is left as it was.
+func traceResponse(resp *http.Response) {
+	if !trace.SpanFromContext(resp.Request.Context()).IsRecording() {
+		return
+	}
+	carrier := propagation.HeaderCarrier(http.Header{})
+	tracePropagator.Inject(resp.Request.Context(), carrier)
+	resp.Header.Set("Traceparent", carrier.Get("Traceparent"))
+}
+
+// tracingTransport records the upstream's status and latency, including any
+// retries, on the request's span.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	span.SetAttributes(attribute.Int64("proxy.upstream.duration_ms", time.Since(start).Milliseconds()))
+	if err != nil {
+		span.RecordError(err)
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("proxy.upstream.status_code", resp.StatusCode))
+	return resp, err
+}
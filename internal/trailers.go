@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Summary trailers sent after the response body with WithSummaryTrailers.
+const (
+	// UpstreamDurationTrailer is the time in seconds from forwarding the
+	// request to the end of the upstream response body, retries included.
+	UpstreamDurationTrailer = "X-Upstream-Duration"
+	// UpstreamStatusTrailer is the status the upstream answered with.
+	UpstreamStatusTrailer = "X-Upstream-Status"
+	// UpstreamBytesTrailer is the size of the upstream response body.
+	UpstreamBytesTrailer = "X-Upstream-Bytes"
+)
+
+// summaryTrailers computes each known summary trailer.
+var summaryTrailers = map[string]func(b *summaryBody) string{
+	UpstreamDurationTrailer: func(b *summaryBody) string {
+		return strconv.FormatFloat(time.Since(b.start).Seconds(), 'f', 3, 64)
+	},
+	UpstreamStatusTrailer: func(b *summaryBody) string {
+		return strconv.Itoa(b.resp.StatusCode)
+	},
+	UpstreamBytesTrailer: func(b *summaryBody) string {
+		return strconv.FormatInt(b.read, 10)
+	},
+}
+
+type upstreamStartKey struct{}
+
+// withUpstreamStart records when the request was forwarded.
+func withUpstreamStart(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamStartKey{}, time.Now())
+}
+
+// addSummaryTrailers announces the named trailers on resp, filling them in
+// once its body has been copied to the client. Trailers need a chunked
+// response, so any Content-Length is dropped.
+func addSummaryTrailers(resp *http.Response, names []string) {
+	if !hasBody(resp) {
+		return
+	}
+	start, _ := resp.Request.Context().Value(upstreamStartKey{}).(time.Time)
+
+	if resp.Trailer == nil {
+		resp.Trailer = http.Header{}
+	}
+	var known []string
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := summaryTrailers[name]; ok {
+			resp.Trailer[name] = nil
+			known = append(known, name)
+		}
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	resp.Body = &summaryBody{ReadCloser: resp.Body, resp: resp, names: known, start: start}
+}
+
+// summaryBody sets the summary trailers on resp when closed, which
+// ReverseProxy does before sending the trailers.
+type summaryBody struct {
+	io.ReadCloser
+	resp  *http.Response
+	names []string
+	start time.Time
+	read  int64
+	once  sync.Once
+}
+
+func (b *summaryBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *summaryBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		for _, name := range b.names {
+			b.resp.Trailer.Set(name, summaryTrailers[name](b))
+		}
+	})
+	return err
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+)
+
+// RequestBodyTransformer rewrites a request body on its way upstream. It
+// receives the body as read from the client and returns what to forward.
+type RequestBodyTransformer func(body io.Reader) io.Reader
+
+// transformBody applies fn to out's body, including any replayed for a
+// retry. The transformed length isn't known up front, so the body is sent
+// chunked.
+func transformBody(out *http.Request, fn RequestBodyTransformer) {
+	if out.Body == nil || out.Body == http.NoBody {
+		return
+	}
+	out.Body = readCloser{Reader: fn(out.Body), Closer: out.Body}
+	if getBody := out.GetBody; getBody != nil {
+		out.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return readCloser{Reader: fn(body), Closer: body}, nil
+		}
+	}
+	out.ContentLength = -1
+	out.Header.Del("Content-Length")
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// restrictUpgrades rejects protocol upgrade requests (Connection: Upgrade) for
+// protocols not in allowed with 400. Allowed upgrades, WebSocket or otherwise,
+// are passed through by ReverseProxy, which relays the 101 and then copies
+// bytes in both directions.
+func restrictUpgrades(allowed []string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			protocol := r.Header.Get("Upgrade")
+			if !upgradeAllowed(allowed, protocol) {
+				http.Error(w, "upgrade to "+protocol+" is not allowed", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// upgradeAllowed matches the protocol name, ignoring case and any "/version" suffix.
+func upgradeAllowed(allowed []string, protocol string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(protocol), "/")
+	for _, a := range allowed {
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
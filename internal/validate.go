@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Validate checks the configuration for invariants the options can't enforce
+// individually. All problems are reported together, each prefixed with the
+// offending field name.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if b, ok := c.Balancer.(*AdaptiveBalancer); ok {
+		if len(b.targets) == 0 {
+			fail("Balancer", "must have at least one upstream target")
+		}
+		for i, t := range b.targets {
+			if t.url == nil || t.url.Scheme == "" || t.url.Host == "" {
+				fail(fmt.Sprintf("Balancer.targets[%d]", i), "must be an absolute URL with scheme and host")
+			}
+			if t.healthPath != "" && !strings.HasPrefix(t.healthPath, "/") {
+				fail(fmt.Sprintf("Balancer.targets[%d].HealthCheckPath", i), "must start with /, got %q", t.healthPath)
+			}
+			if t.maxConcurrent < 0 {
+				fail(fmt.Sprintf("Balancer.targets[%d].MaxConcurrent", i), "must not be negative, got %d", t.maxConcurrent)
+			}
+		}
+		if b.Decay <= 0 || b.Decay > 1 {
+			fail("Balancer.Decay", "must be in (0, 1], got %v", b.Decay)
+		}
+	}
+
+	for i, key := range c.APIKeys {
+		if key == "" {
+			fail(fmt.Sprintf("APIKeys[%d]", i), "must not be empty")
+		}
+	}
+
+	if c.ResetRetries < 0 {
+		fail("ResetRetries", "must not be negative, got %d", c.ResetRetries)
+	}
+	if c.MaxClientRetries < 0 {
+		fail("MaxClientRetries", "must not be negative, got %d", c.MaxClientRetries)
+	}
+	if c.MaxClientRetries > 0 && c.ClientRetryWindow <= 0 {
+		fail("ClientRetryWindow", "must be positive when MaxClientRetries is set, got %s", c.ClientRetryWindow)
+	}
+
+	if c.DefaultHost != "" && c.RejectMissingHost {
+		fail("DefaultHost", "must not be set together with RejectMissingHost")
+	}
+
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		fail("TrustedProxies", "%s", err)
+	}
+	if _, err := parseCIDRs(c.AllowedCIDRs); err != nil {
+		fail("AllowedCIDRs", "%s", err)
+	}
+	if _, err := parseCIDRs(c.DeniedCIDRs); err != nil {
+		fail("DeniedCIDRs", "%s", err)
+	}
+
+	if c.BodyReadTimeout < 0 {
+		fail("BodyReadTimeout", "must not be negative, got %s", c.BodyReadTimeout)
+	}
+
+	if c.ErrorBodyLogLimit < 0 {
+		fail("ErrorBodyLogLimit", "must not be negative, got %d", c.ErrorBodyLogLimit)
+	}
+
+	for i, d := range c.Deprecations {
+		if !strings.HasPrefix(d.PathPrefix, "/") {
+			fail(fmt.Sprintf("Deprecations[%d].PathPrefix", i), "must start with /, got %q", d.PathPrefix)
+		}
+		if d.Since.IsZero() {
+			fail(fmt.Sprintf("Deprecations[%d].Since", i), "must be set")
+		}
+	}
+
+	for i, f := range c.Features {
+		if f.Name == "" || strings.Contains(f.Name, ",") {
+			fail(fmt.Sprintf("Features[%d].Name", i), "must be non-empty and contain no commas, got %q", f.Name)
+		}
+		if f.Middleware == nil {
+			fail(fmt.Sprintf("Features[%d].Middleware", i), "must not be nil")
+		}
+	}
+
+	if c.DrainLogInterval < 0 {
+		fail("DrainLogInterval", "must not be negative, got %s", c.DrainLogInterval)
+	}
+
+	if c.RetryAttempts < 0 {
+		fail("RetryAttempts", "must not be negative, got %d", c.RetryAttempts)
+	}
+	if c.RetryBaseDelay < 0 {
+		fail("RetryBaseDelay", "must not be negative, got %s", c.RetryBaseDelay)
+	}
+
+	for i, f := range c.TokenFields {
+		if f == "" || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") || strings.Contains(f, "..") {
+			fail(fmt.Sprintf("TokenFields[%d]", i), "must be a dotted field path, got %q", f)
+		}
+	}
+
+	if err := checkBuckets(c.BodySizeBuckets); err != nil {
+		fail("BodySizeBuckets", "%s", err)
+	}
+
+	if c.HealthPath != "" && !strings.HasPrefix(c.HealthPath, "/") {
+		fail("HealthPath", "must start with /, got %q", c.HealthPath)
+	}
+	if c.HealthPath != "" && !strings.HasPrefix(c.HealthCheckPath, "/") {
+		fail("HealthCheckPath", "must start with /, got %q", c.HealthCheckPath)
+	}
+	if c.HealthyStatus != 0 && (c.HealthyStatus < 100 || c.HealthyStatus > 599) {
+		fail("HealthyStatus", "must be a valid HTTP status, got %d", c.HealthyStatus)
+	}
+	if c.HealthPath != "" && c.HealthCheckTimeout <= 0 {
+		fail("HealthCheckTimeout", "must be positive, got %s", c.HealthCheckTimeout)
+	}
+
+	for path := range c.StaticResponses {
+		if !strings.HasPrefix(path, "/") {
+			fail("StaticResponses", "path must start with /, got %q", path)
+		}
+	}
+
+	if c.RateLimit < 0 || math.IsNaN(c.RateLimit) || math.IsInf(c.RateLimit, 0) {
+		fail("RateLimit", "must be a non-negative number, got %v", c.RateLimit)
+	}
+	if c.RateLimit > 0 && c.RateLimitBurst < 1 {
+		fail("RateLimitBurst", "must be at least 1 when RateLimit is set, got %d", c.RateLimitBurst)
+	}
+	if c.RateLimitStateFile != "" && c.RateLimit <= 0 {
+		fail("RateLimitStateFile", "requires RateLimit to be set")
+	}
+
+	if c.EjectionThreshold < 0 {
+		fail("EjectionThreshold", "must not be negative, got %d", c.EjectionThreshold)
+	}
+	if c.EjectionThreshold > 0 && c.EjectionDuration <= 0 {
+		fail("EjectionDuration", "must be positive when EjectionThreshold is set, got %s", c.EjectionDuration)
+	}
+
+	if c.RequestIDHeader == "" {
+		fail("RequestIDHeader", "must not be empty")
+	}
+
+	for i, p := range c.CORS {
+		if !strings.HasPrefix(p.PathPrefix, "/") {
+			fail(fmt.Sprintf("CORS[%d].PathPrefix", i), "must start with /, got %q", p.PathPrefix)
+		}
+		if len(p.AllowedOrigins) == 0 {
+			fail(fmt.Sprintf("CORS[%d].AllowedOrigins", i), "must not be empty")
+		}
+	}
+
+	for i, name := range c.SummaryTrailers {
+		if _, ok := summaryTrailers[http.CanonicalHeaderKey(name)]; !ok {
+			fail(fmt.Sprintf("SummaryTrailers[%d]", i), "unknown trailer %q", name)
+		}
+	}
+
+	if c.IdempotencyStore != nil && c.IdempotencyTTL <= 0 {
+		fail("IdempotencyTTL", "must be positive when IdempotencyStore is set, got %s", c.IdempotencyTTL)
+	}
+
+	if c.MaxRequestBytes < 0 {
+		fail("MaxRequestBytes", "must not be negative, got %d", c.MaxRequestBytes)
+	}
+	if c.MaxResponseBytes < 0 {
+		fail("MaxResponseBytes", "must not be negative, got %d", c.MaxResponseBytes)
+	}
+	if c.BufferedBodyBytes < 0 {
+		fail("BufferedBodyBytes", "must not be negative, got %d", c.BufferedBodyBytes)
+	}
+
+	if c.MaxConcurrent < 0 {
+		fail("MaxConcurrent", "must not be negative, got %d", c.MaxConcurrent)
+	}
+	if c.MaxQueuedPerClient < 0 {
+		fail("MaxQueuedPerClient", "must not be negative, got %d", c.MaxQueuedPerClient)
+	}
+
+	if c.Shadow != nil {
+		if c.Shadow.Scheme == "" || c.Shadow.Host == "" {
+			fail("Shadow", "must be an absolute URL with scheme and host")
+		}
+		if c.ShadowFraction < 0 || c.ShadowFraction > 1 || math.IsNaN(c.ShadowFraction) {
+			fail("ShadowFraction", "must be in [0, 1], got %v", c.ShadowFraction)
+		}
+		if c.ShadowTimeout <= 0 {
+			fail("ShadowTimeout", "must be positive when Shadow is set, got %s", c.ShadowTimeout)
+		}
+	}
+	for i, rule := range c.ShadowRules {
+		field := fmt.Sprintf("ShadowRules[%d]", i)
+		if c.Shadow == nil {
+			fail(field, "requires Shadow to be set")
+		}
+		if rule.Fraction < 0 || rule.Fraction > 1 || math.IsNaN(rule.Fraction) {
+			fail(field+".Fraction", "must be in [0, 1], got %v", rule.Fraction)
+		}
+		if rule.HeaderValue != "" && rule.Header == "" {
+			fail(field+".HeaderValue", "requires Header to be set")
+		}
+		if _, err := parseCIDRs(rule.ClientCIDRs); err != nil {
+			fail(field+".ClientCIDRs", "%s", err)
+		}
+	}
+
+	if len(c.UpstreamTokenSecret) > 0 && len(c.UpstreamOverrideHosts) == 0 {
+		fail("UpstreamOverrideHosts", "must list the hosts override tokens may route to")
+	}
+
+	if c.Canary != nil {
+		if c.Canary.Scheme == "" || c.Canary.Host == "" {
+			fail("Canary", "must be an absolute URL with scheme and host")
+		}
+		if c.CanaryFraction < 0 || c.CanaryFraction > 1 || math.IsNaN(c.CanaryFraction) {
+			fail("CanaryFraction", "must be in [0, 1], got %v", c.CanaryFraction)
+		}
+	}
+	if c.CanaryHeader != "" && c.Canary == nil {
+		fail("CanaryHeader", "requires Canary to be set")
+	}
+
+	if c.FlushInterval < -1 {
+		fail("FlushInterval", "must be -1, 0 or positive, got %s", c.FlushInterval)
+	}
+
+	if c.MaxHeaderBytes < 0 {
+		fail("MaxHeaderBytes", "must not be negative, got %d", c.MaxHeaderBytes)
+	}
+
+	if c.MaxIdleConns < 0 {
+		fail("MaxIdleConns", "must not be negative, got %d", c.MaxIdleConns)
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		fail("MaxIdleConnsPerHost", "must not be negative, got %d", c.MaxIdleConnsPerHost)
+	}
+
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"ReadTimeout", c.ReadTimeout},
+		{"WriteTimeout", c.WriteTimeout},
+		{"IdleTimeout", c.IdleTimeout},
+		{"ReadHeaderTimeout", c.ReadHeaderTimeout},
+		{"RequestDeadline", c.RequestDeadline},
+		{"RetryAfterMaxWait", c.RetryAfterMaxWait},
+		{"FirstByteTimeout", c.FirstByteTimeout},
+		{"QueueTimeout", c.QueueTimeout},
+		{"WatchdogTimeout", c.WatchdogTimeout},
+	} {
+		if t.d < 0 {
+			fail(t.name, "must not be negative, got %s", t.d)
+		}
+	}
+
+	if c.Logger == nil {
+		fail("Logger", "must not be nil")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateTarget checks that target is an absolute http(s) URL. NewProxy and
+// NewServer assume it is; a schemeless target like "localhost:8000" otherwise
+// parses fine and only fails on the first request.
+func ValidateTarget(target *url.URL) error {
+	if target == nil {
+		return errors.New("target: must not be nil")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("target: must have an http or https scheme, got %q", target.String())
+	}
+	if target.Host == "" {
+		return fmt.Errorf("target: must have a host, got %q", target.String())
+	}
+	return nil
+}
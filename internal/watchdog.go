@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type connKey struct{}
+
+// withConn records the connection a request arrived on, so the watchdog can
+// close it. NewServer sets it through http.Server.ConnContext.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func connFromContext(ctx context.Context) net.Conn {
+	c, _ := ctx.Value(connKey{}).(net.Conn)
+	return c
+}
+
+// watchdog is the last resort for requests still running max after they
+// arrived, whatever other timeouts should have stopped them: it cancels the
+// request and closes the client's connection out from under the handler.
+func watchdog(max time.Duration, logger *log.Logger) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			var mu sync.Mutex
+			done := false
+			timer := time.AfterFunc(max, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				// the connection may already be serving the client's next request.
+				if done {
+					return
+				}
+				logger.Printf("watchdog: killing %s %s after %s", r.Method, r.URL.Path, max)
+				cancel()
+				if conn := connFromContext(r.Context()); conn != nil {
+					conn.Close()
+					return
+				}
+				// not served by NewServer, so the best we can do is fail the
+				// connection's reads and writes.
+				rc := http.NewResponseController(w)
+				rc.SetReadDeadline(time.Now())
+				rc.SetWriteDeadline(time.Now())
+			})
+			defer func() {
+				timer.Stop()
+				mu.Lock()
+				done = true
+				mu.Unlock()
+			}()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
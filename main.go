@@ -1,37 +1,106 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alexeldeib/cohere-reverse-proxy/internal"
 )
 
 func main() {
 	var (
-		address   string
-		targetURL string
+		address         string
+		targetURL       string
+		tokenEndpoint   string
+		tlsCert         string
+		tlsKey          string
+		shutdownTimeout time.Duration
+		debugHeaders    bool
+		adminAddress    string
 	)
 
-	flag.StringVar(&address, "address", "127.0.0.1:8001", "address for reverse proxy to listen on")
-	flag.StringVar(&targetURL, "target", "http://127.0.0.1:8000", "origin server to which the proxy should forward requests")
+	flag.StringVar(&address, "address", "127.0.0.1:8001", "address for reverse proxy to listen on, or unix:///path/to/socket for a unix domain socket. a comma-separated list listens on each")
+	flag.StringVar(&targetURL, "target", "http://127.0.0.1:8000", "origin server to which the proxy should forward requests. a comma-separated list balances between them by latency")
+	flag.StringVar(&tokenEndpoint, "token-endpoint", "", "optional endpoint to fetch short-lived upstream bearer tokens from")
+	flag.StringVar(&tlsCert, "tls-cert", "", "optional certificate file to serve https with. requires -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "optional private key file to serve https with. requires -tls-cert")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to let in-flight requests drain on SIGINT/SIGTERM before exiting")
+
+	flag.StringVar(&adminAddress, "admin-address", "", "optional address to serve pprof and expvar debug endpoints on, under /debug/")
+	flag.BoolVar(&debugHeaders, "debug-headers", false, "log the headers the proxy adds, removes or modifies on each request and response")
 
 	flag.Parse()
 
-	url, err := url.Parse(targetURL)
+	var targets []internal.WeightedTarget
+	for _, raw := range strings.Split(targetURL, ",") {
+		target, err := url.Parse(raw)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		targets = append(targets, internal.WeightedTarget{URL: target, Weight: 1})
+	}
+
+	var opts []internal.Option
+	if len(targets) > 1 {
+		opts = append(opts, internal.WithBalancer(internal.NewAdaptiveBalancer(targets...)))
+	}
+	if adminAddress != "" {
+		opts = append(opts, internal.WithDebugEndpoints(), internal.WithAdminAddress(adminAddress))
+	}
+	if debugHeaders {
+		opts = append(opts, internal.WithHeaderDiffLogging())
+	}
+	if tokenEndpoint != "" {
+		opts = append(opts, internal.WithTokenSource(internal.NewRefreshingTokenSource(tokenEndpoint)))
+	}
+
+	srv, err := internal.NewValidatedServer(targets[0].URL, opts...)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	srv := internal.NewServer(url)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Println("Starting up the server")
 
-	if err := srv.ListenAndServe(address); err != nil {
+	served := make(chan error, 1)
+	go func() {
+		if tlsCert != "" || tlsKey != "" {
+			served <- srv.ListenAndServeTLS(address, tlsCert, tlsKey)
+		} else {
+			served <- srv.ListenAndServe(address)
+		}
+	}()
+
+	select {
+	case err := <-served:
 		log.Println(err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	// a second signal kills the process immediately.
+	stop()
+
+	log.Printf("Shutting down, %d requests in flight", srv.ActiveRequests())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown did not complete: %s", err)
+		os.Exit(1)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
 	}
 
 	log.Println("Server stopped cleanly")
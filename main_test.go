@@ -1,16 +1,46 @@
 package main_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
+	"maps"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alexeldeib/cohere-reverse-proxy/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func Test_Proxy_Origin_Request(t *testing.T) {
@@ -151,3 +181,5276 @@ func Test_Live_Server_Fails_Calling_Serve_Without_Listen(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, err.Error(), "must call Listen() before Serve()")
 }
+
+func Test_Proxy_Token_Refresh(t *testing.T) {
+	var issued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 1}`, n)
+	}))
+	defer tokenServer.Close()
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenSource := internal.NewRefreshingTokenSource(tokenServer.URL)
+	tokenSource.EarlyExpiry = 0
+
+	proxy := internal.NewProxy(targetUrl, internal.WithTokenSource(tokenSource))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	get := func() string {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	assert.Equal(t, get(), "Bearer token-1")
+	assert.Equal(t, get(), "Bearer token-1")
+
+	// wait for the first token to expire.
+	time.Sleep(1100 * time.Millisecond)
+
+	assert.Equal(t, get(), "Bearer token-2")
+	assert.Equal(t, atomic.LoadInt32(&issued), int32(2))
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, for capturing logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func Test_Live_Server_Reports_Drain_Progress(t *testing.T) {
+	release := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "drained")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+	srv := internal.NewServer(targetUrl,
+		internal.WithLogger(log.New(&logs, "", 0)),
+		internal.WithDrainLogInterval(20*time.Millisecond),
+	)
+
+	assert.NoError(t, srv.Listen("127.0.0.1:0"))
+	go srv.Serve()
+
+	respCh := make(chan string)
+	go func() {
+		resp, err := http.Get(srv.URL())
+		if err != nil {
+			respCh <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		respCh <- string(b)
+	}()
+
+	assert.Eventually(t, func() bool { return srv.ActiveRequests() == 1 }, time.Second, 5*time.Millisecond)
+
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "1 active requests remaining")
+	}, time.Second, 5*time.Millisecond)
+
+	close(release)
+
+	assert.Equal(t, <-respCh, "drained\n")
+	assert.NoError(t, <-shutdownErr)
+	assert.Equal(t, srv.ActiveRequests(), int64(0))
+}
+
+func Test_Proxy_Adaptive_Balancer_Prefers_Faster_Backend(t *testing.T) {
+	var fastCount, slowCount int32
+	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fastCount, 1)
+		fmt.Fprintln(w, "fast")
+	}))
+	defer fastServer.Close()
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowCount, 1)
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(w, "slow")
+	}))
+	defer slowServer.Close()
+
+	fastUrl, err := url.Parse(fastServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowUrl, err := url.Parse(slowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer := internal.NewAdaptiveBalancer(
+		internal.WeightedTarget{URL: fastUrl, Weight: 1},
+		internal.WeightedTarget{URL: slowUrl, Weight: 1},
+	)
+
+	proxy := internal.NewProxy(fastUrl, internal.WithBalancer(balancer))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, atomic.LoadInt32(&fastCount)+atomic.LoadInt32(&slowCount), int32(100))
+	assert.Greater(t, atomic.LoadInt32(&fastCount), 4*atomic.LoadInt32(&slowCount))
+}
+
+func Test_Proxy_Adaptive_Balancer_Avoids_Fast_Failing_Backends(t *testing.T) {
+	var healthyCount, failingCount int32
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyCount, 1)
+		time.Sleep(5 * time.Millisecond)
+		fmt.Fprintln(w, "ok")
+	}))
+	defer healthyServer.Close()
+
+	// fails instantly, so looks fastest by latency alone.
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingCount, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	healthyUrl, err := url.Parse(healthyServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failingUrl, err := url.Parse(failingServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer := internal.NewAdaptiveBalancer(
+		internal.WeightedTarget{URL: healthyUrl, Weight: 1},
+		internal.WeightedTarget{URL: failingUrl, Weight: 1},
+	)
+
+	frontendServer := httptest.NewServer(internal.NewProxy(healthyUrl, internal.WithBalancer(balancer)))
+	defer frontendServer.Close()
+
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, atomic.LoadInt32(&healthyCount)+atomic.LoadInt32(&failingCount), int32(100))
+	assert.Greater(t, atomic.LoadInt32(&healthyCount), 4*atomic.LoadInt32(&failingCount))
+}
+
+// rawBackend serves each accepted connection with handle, for backends that
+// need to misbehave at the TCP level.
+func rawBackend(t *testing.T, handle func(n int, conn *net.TCPConn)) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(n, conn.(*net.TCPConn))
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// resetConn drops conn with a TCP RST instead of a clean FIN.
+func resetConn(conn *net.TCPConn) {
+	conn.SetLinger(0)
+	conn.Close()
+}
+
+func Test_Proxy_Upstream_Reset_Mid_Body(t *testing.T) {
+	targetUrl := rawBackend(t, func(n int, conn *net.TCPConn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\npartial")
+		time.Sleep(50 * time.Millisecond)
+		resetConn(conn)
+	})
+
+	var logs syncBuffer
+	reg := prometheus.NewRegistry()
+	proxy := internal.NewProxy(targetUrl, internal.WithLogger(log.New(&logs, "", 0)), internal.WithMetricsRegistry(reg))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+	assert.Contains(t, logs.String(), "upstream connection failed mid-body")
+	assert.Contains(t, logs.String(), "after 7 bytes")
+}
+
+func Test_Proxy_Retries_Idempotent_Request_On_Reset(t *testing.T) {
+	targetUrl := rawBackend(t, func(n int, conn *net.TCPConn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		if n == 0 {
+			resetConn(conn)
+			return
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 9\r\nConnection: close\r\n\r\nrecovered")
+		conn.Close()
+	})
+
+	var logs syncBuffer
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithLogger(log.New(&logs, "", 0)),
+		internal.WithRetryOnReset(1),
+	)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, string(b), "recovered")
+	assert.Equal(t, resp.Header.Get(internal.UpstreamAttemptsHeader), "2")
+	assert.Contains(t, logs.String(), "retrying")
+}
+
+// newLiveServer starts a proxy server for target on a random local port.
+func newLiveServer(t *testing.T, target *url.URL, opts ...internal.Option) *internal.Server {
+	srv := internal.NewServer(target, opts...)
+	assert.NoError(t, srv.Listen("127.0.0.1:0"))
+	go srv.Serve()
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv
+}
+
+func Test_Live_Server_Validates_Body_Checksums(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl, internal.WithChecksumValidation())
+
+	body := `{"prompt": "hello"}`
+	md5sum := md5.Sum([]byte(body))
+	sha := sha256.Sum256([]byte(body))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"valid content-md5", "Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]), http.StatusOK},
+		{"valid digest", "Digest", "SHA-256=" + base64.StdEncoding.EncodeToString(sha[:]), http.StatusOK},
+		{"tampered content-md5", "Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)), http.StatusBadRequest},
+		{"tampered digest", "Digest", "sha-256=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL(), strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(tt.header, tt.value)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, string(b), body)
+			} else {
+				assert.Equal(t, resp.Header.Get("Content-Type"), "application/json")
+				assert.Contains(t, string(b), `"type":"checksum_mismatch"`)
+			}
+		})
+	}
+}
+
+func Test_Live_Server_Caps_Checksummed_Bodies(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl, internal.WithChecksumValidation())
+
+	// hide the length, so the cap has to catch it while reading.
+	body := io.MultiReader(strings.NewReader(strings.Repeat("a", 32<<20+1)))
+	req, err := http.NewRequest(http.MethodPost, srv.URL(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+// rawRequest writes a literal request to addr and returns the parsed response.
+func rawRequest(t *testing.T, addr, request string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func Test_Live_Server_Missing_Host(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("default host", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, internal.WithDefaultHost("legacy.example.com"))
+		resp := rawRequest(t, strings.TrimPrefix(srv.URL(), "http://"), "GET / HTTP/1.0\r\n\r\n")
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, string(b), "legacy.example.com")
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, internal.WithRejectMissingHost())
+		resp := rawRequest(t, strings.TrimPrefix(srv.URL(), "http://"), "GET / HTTP/1.0\r\n\r\n")
+		defer resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+}
+
+func Test_Proxy_Signed_Upstream_Override(t *testing.T) {
+	defaultServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "default token=%q", r.Header.Get(internal.UpstreamTokenHeader))
+	}))
+	defer defaultServer.Close()
+
+	overrideServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "override token=%q", r.Header.Get(internal.UpstreamTokenHeader))
+	}))
+	defer overrideServer.Close()
+
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "other")
+	}))
+	defer otherServer.Close()
+
+	defaultUrl, err := url.Parse(defaultServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrideUrl, err := url.Parse(overrideServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUrl, err := url.Parse(otherServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("s3cret")
+	proxy := internal.NewProxy(defaultUrl,
+		internal.WithSignedUpstreamOverride(secret, overrideUrl.Host),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	expires := time.Now().Add(time.Hour)
+	valid := internal.SignUpstream(secret, overrideUrl, expires)
+	forged := internal.SignUpstream([]byte("not the secret"), overrideUrl, expires)
+	expired := internal.SignUpstream(secret, overrideUrl, time.Now().Add(-time.Second))
+	// on the allowed hostname, but a different port.
+	disallowed := internal.SignUpstream(secret, otherUrl, expires)
+	encodedURL, _, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"no token", "", `default token=""`},
+		{"valid token", valid, `override token=""`},
+		{"forged token", forged, `default token=""`},
+		{"unsigned token", encodedURL, `default token=""`},
+		{"expired token", expired, `default token=""`},
+		{"disallowed host", disallowed, `default token=""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set(internal.UpstreamTokenHeader, tt.token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, string(b), tt.want)
+		})
+	}
+}
+
+func Test_Live_Server_HTTP10_Keep_Alive(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := "GET / HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n"
+
+	tests := []struct {
+		name      string
+		opts      []internal.Option
+		keepAlive bool
+	}{
+		{"honored by default", nil, true},
+		{"downgraded", []internal.Option{internal.WithoutHTTP10KeepAlive()}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newLiveServer(t, targetUrl, tt.opts...)
+
+			conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL(), "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			io.WriteString(conn, request)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, resp.Close, !tt.keepAlive)
+
+			// a second request only succeeds on a kept-alive connection.
+			io.WriteString(conn, request)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = http.ReadResponse(reader, nil)
+			if tt.keepAlive {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Rotates_API_Key_On_Auth_Failure(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		seen = append(seen, auth)
+		mu.Unlock()
+		if auth == "Bearer revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, auth)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl, internal.WithAPIKeys("revoked", "valid"))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, string(b), "Bearer valid")
+	}
+
+	// the revoked key is only tried once; later requests start with the valid key.
+	assert.Equal(t, seen, []string{"Bearer revoked", "Bearer valid", "Bearer valid"})
+}
+
+func Test_Proxy_Retires_Rejected_API_Key_On_Post(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		seen = append(seen, auth)
+		mu.Unlock()
+		if auth == "Bearer revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, auth)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithAPIKeys("revoked", "good")))
+	defer frontendServer.Close()
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(frontendServer.URL+"/v1/generate", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	// the POST itself isn't retried, but the next one uses the next key.
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusOK, http.StatusOK}, statuses)
+	assert.Equal(t, []string{"Bearer revoked", "Bearer good", "Bearer good"}, seen)
+}
+
+func Test_Handler_Applies_Middleware(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := internal.NewHandler(targetUrl,
+		internal.WithAPIKeys("key"),
+		internal.WithChecksumValidation(),
+		internal.WithDefaultHost("legacy.example.com"),
+	)
+
+	// exercise the handler directly, without a server in front of it.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Host = ""
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), "Bearer key legacy.example.com")
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+}
+
+func Test_Proxy_Caps_Retries_Per_Client(t *testing.T) {
+	var attempts int32
+	targetUrl := rawBackend(t, func(n int, conn *net.TCPConn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		atomic.AddInt32(&attempts, 1)
+		resetConn(conn)
+	})
+
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+		internal.WithRetryOnReset(1),
+		internal.WithClientRetryLimit(2, time.Minute),
+	)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	for _, want := range []int32{2, 4, 5, 6} {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+		assert.Equal(t, atomic.LoadInt32(&attempts), want)
+	}
+}
+
+// grpcFrame encodes msg as a length-prefixed gRPC message with the given flags.
+func grpcFrame(flags byte, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func Test_Proxy_Translates_GRPC_Web(t *testing.T) {
+	grpcHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("Te") != "trailers" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) < 5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Write(grpcFrame(0, append([]byte("echo:"), body[5:]...)))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "OK")
+	})
+
+	backendServer := httptest.NewServer(h2c.NewHandler(grpcHandler, &http2.Server{}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := internal.NewHandler(targetUrl, internal.WithGRPCWeb())
+
+	frontendServer := httptest.NewServer(handler)
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, frontendServer.URL+"/echo.Echo/Say", bytes.NewReader(grpcFrame(0, []byte("hello"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/grpc-web+proto")
+	assert.Empty(t, resp.Trailer)
+
+	trailers := "grpc-message: OK\r\ngrpc-status: 0\r\n"
+	want := append(grpcFrame(0, []byte("echo:hello")), grpcFrame(0x80, []byte(trailers))...)
+	assert.Equal(t, b, want)
+}
+
+func Test_Proxy_Flushes_SSE_Heartbeats(t *testing.T) {
+	heartbeats := make(chan struct{})
+	done := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for range heartbeats {
+			fmt.Fprint(w, ": ping\n\n")
+			w.(http.Flusher).Flush()
+		}
+		<-done
+	}))
+	defer backendServer.Close()
+	defer close(done)
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	for i := 0; i < 3; i++ {
+		heartbeats <- struct{}{}
+
+		// the upstream keeps the stream open, so each heartbeat is only
+		// readable if the proxy flushed it through.
+		line := make(chan string)
+		go func() {
+			l, _ := reader.ReadString('\n')
+			reader.ReadString('\n')
+			line <- l
+		}()
+
+		select {
+		case l := <-line:
+			assert.Equal(t, l, ": ping\n")
+		case <-time.After(time.Second):
+			t.Fatal("heartbeat was not flushed to the client")
+		}
+	}
+	close(heartbeats)
+}
+
+func Test_Config_Validate(t *testing.T) {
+	valid, err := url.Parse("http://127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []internal.Option
+		errs []string
+	}{
+		{
+			name: "valid",
+			opts: []internal.Option{
+				internal.WithBalancer(internal.NewAdaptiveBalancer(internal.WeightedTarget{URL: valid})),
+				internal.WithAPIKeys("key"),
+				internal.WithClientRetryLimit(3, time.Minute),
+			},
+		},
+		{
+			name: "no upstreams",
+			opts: []internal.Option{internal.WithBalancer(internal.NewAdaptiveBalancer())},
+			errs: []string{"Balancer: must have at least one upstream target"},
+		},
+		{
+			name: "relative upstream",
+			opts: []internal.Option{internal.WithBalancer(internal.NewAdaptiveBalancer(internal.WeightedTarget{URL: &url.URL{Path: "/"}}))},
+			errs: []string{"Balancer.targets[0]: must be an absolute URL"},
+		},
+		{
+			name: "empty api key",
+			opts: []internal.Option{internal.WithAPIKeys("key", "")},
+			errs: []string{"APIKeys[1]: must not be empty"},
+		},
+		{
+			name: "negative reset retries",
+			opts: []internal.Option{internal.WithRetryOnReset(-1)},
+			errs: []string{"ResetRetries: must not be negative"},
+		},
+		{
+			name: "retry limit without window",
+			opts: []internal.Option{internal.WithClientRetryLimit(3, 0)},
+			errs: []string{"ClientRetryWindow: must be positive"},
+		},
+		{
+			name: "conflicting host handling",
+			opts: []internal.Option{internal.WithDefaultHost("example.com"), internal.WithRejectMissingHost()},
+			errs: []string{"DefaultHost: must not be set together with RejectMissingHost"},
+		},
+		{
+			name: "negative drain interval",
+			opts: []internal.Option{internal.WithDrainLogInterval(-time.Second)},
+			errs: []string{"DrainLogInterval: must not be negative"},
+		},
+		{
+			name: "invalid trusted proxy",
+			opts: []internal.Option{internal.WithTrustedProxies([]string{"10.0.0.0/33"})},
+			errs: []string{"TrustedProxies: invalid CIDR"},
+		},
+		{
+			name: "nil logger",
+			opts: []internal.Option{internal.WithLogger(nil)},
+			errs: []string{"Logger: must not be nil"},
+		},
+		{
+			name: "aggregated",
+			opts: []internal.Option{internal.WithAPIKeys(""), internal.WithLogger(nil)},
+			errs: []string{"APIKeys[0]: must not be empty", "Logger: must not be nil"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := internal.NewConfig(tt.opts...).Validate()
+			if len(tt.errs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			for _, want := range tt.errs {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func Test_NewValidatedServer_Rejects_Malformed_Target(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		err    string
+	}{
+		{"valid", "http://127.0.0.1:8000", ""},
+		{"schemeless", "localhost:8000", `target: must have an http or https scheme, got "localhost:8000"`},
+		{"no host", "http:///v1/chat", "target: must have a host"},
+		{"unsupported scheme", "ftp://127.0.0.1", "target: must have an http or https scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv, err := internal.NewValidatedServer(target)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				assert.NotNil(t, srv)
+				return
+			}
+			assert.Nil(t, srv)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func Test_Live_Server_Listens_On_Multiple_Addresses(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := internal.NewServer(targetUrl)
+	assert.NoError(t, srv.Listen("127.0.0.1:0,127.0.0.1:0"))
+
+	go srv.Serve()
+	defer srv.Shutdown(context.Background())
+
+	urls := srv.URLs()
+	assert.Len(t, urls, 2)
+	assert.NotEqual(t, urls[0], urls[1])
+	assert.Equal(t, srv.URL(), urls[0])
+
+	for _, u := range urls {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, string(b), "reverse proxied\n")
+	}
+}
+
+func Test_Handler_Requires_TLS_Behind_Trusted_Proxy(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		proto   string
+		status  int
+	}{
+		{"trusted https", []string{"127.0.0.0/8"}, "https", http.StatusOK},
+		{"trusted http", []string{"127.0.0.0/8"}, "http", http.StatusForbidden},
+		{"trusted no header", []string{"127.0.0.0/8"}, "", http.StatusForbidden},
+		{"untrusted spoofed https", []string{"10.0.0.0/8"}, "https", http.StatusForbidden},
+		{"trusted after spoofed leading https", []string{"127.0.0.0/8"}, "https, http", http.StatusForbidden},
+		{"trusted appended https", []string{"127.0.0.0/8"}, "http, https", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := internal.NewHandler(targetUrl,
+				internal.WithRequireTLS(),
+				internal.WithTrustedProxies(tt.trusted),
+			)
+
+			frontendServer := httptest.NewServer(handler)
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+		})
+	}
+}
+
+func Test_Live_Server_Body_Read_Timeout(t *testing.T) {
+	var received int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err == nil {
+			atomic.AddInt32(&received, 1)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl,
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+		internal.WithBodyReadTimeout(100*time.Millisecond),
+	)
+
+	body, writer := io.Pipe()
+	go func() {
+		io.WriteString(writer, "slow")
+		time.Sleep(time.Second)
+		io.WriteString(writer, "loris")
+		writer.Close()
+	}()
+
+	start := time.Now()
+	resp, err := http.Post(srv.URL(), "text/plain", body)
+	if err == nil {
+		resp.Body.Close()
+		assert.NotEqual(t, resp.StatusCode, http.StatusOK)
+	}
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, atomic.LoadInt32(&received), int32(0))
+}
+
+func Test_Proxy_Reports_Upstream_Attempts(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl, internal.WithAPIKeys("revoked", "expired", "valid"))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	// the first request walks through every key; the second starts on the valid one.
+	for _, want := range []string{"3", ""} {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, resp.Header.Get(internal.UpstreamAttemptsHeader), want)
+	}
+}
+
+func Test_Proxy_Empty_Upstream_Responses(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/no-content" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		opts   []internal.Option
+		status int
+	}{
+		{"204 passthrough", "/no-content", nil, http.StatusNoContent},
+		{"empty 200 passthrough", "/empty", nil, http.StatusOK},
+		{"empty 200 mapped", "/empty", []internal.Option{internal.WithEmptyAsNoContent()}, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, tt.opts...))
+			defer frontendServer.Close()
+
+			client := &http.Client{Timeout: time.Second}
+			resp, err := client.Get(frontendServer.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Empty(t, b)
+			assert.Empty(t, resp.TransferEncoding)
+			assert.Empty(t, resp.Header.Get(internal.UpstreamAttemptsHeader))
+			if tt.status == http.StatusNoContent {
+				assert.Empty(t, resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func Test_Proxy_Without_XForwarded(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Forwarded-") {
+				fmt.Fprintln(w, name)
+			}
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl, internal.WithoutXForwarded())
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, string(b))
+}
+
+func Test_Proxy_Logs_Gzipped_Error_Bodies(t *testing.T) {
+	errorJSON := `{"message":"internal server error"}`
+
+	gzipped := func(s string) []byte {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		io.WriteString(zw, s)
+		zw.Close()
+		return compressed.Bytes()
+	}
+	compressed := bytes.NewBuffer(gzipped(errorJSON))
+	// compresses to well under the log limit, but expands far past it.
+	bomb := gzipped(strings.Repeat("a", 1<<20))
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusInternalServerError)
+		if r.URL.Path == "/bomb" {
+			w.Write(bomb)
+			return
+		}
+		w.Write(compressed.Bytes())
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithLogger(log.New(&logs, "", 0)),
+		internal.WithErrorBodyLogging(1024),
+	)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	// ask for gzip explicitly so the client doesn't transparently decompress.
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, b, compressed.Bytes())
+	assert.Contains(t, logs.String(), "upstream returned 500 for GET")
+	assert.Contains(t, logs.String(), errorJSON)
+
+	req.URL.Path = "/bomb"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	assert.Contains(t, logs.String(), strings.Repeat("a", 1024))
+	assert.NotContains(t, logs.String(), strings.Repeat("a", 1025))
+}
+
+func Test_Proxy_API_Key_Round_Robin(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithAPIKeys("a", "b", "c"),
+		internal.WithAPIKeyRoundRobin(),
+	)
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	var seen []string
+	for i := 0; i < 6; i++ {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, string(b))
+	}
+
+	assert.Equal(t, seen, []string{"Bearer a", "Bearer b", "Bearer c", "Bearer a", "Bearer b", "Bearer c"})
+}
+
+func Test_Handler_Generic_Upgrade(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo/1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo/1\r\n\r\n")
+		rw.Flush()
+
+		line, _ := rw.ReadString('\n')
+		fmt.Fprint(rw, line)
+		rw.Flush()
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo/1\r\n\r\n"
+
+	t.Run("passed through", func(t *testing.T) {
+		frontendServer := httptest.NewServer(internal.NewHandler(targetUrl))
+		defer frontendServer.Close()
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(frontendServer.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		io.WriteString(conn, request)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+		assert.Equal(t, resp.Header.Get("Upgrade"), "echo/1")
+
+		io.WriteString(conn, "over the upgraded connection\n")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, line, "over the upgraded connection\n")
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithAllowedUpgrades("websocket")))
+		defer frontendServer.Close()
+
+		resp := rawRequest(t, strings.TrimPrefix(frontendServer.URL, "http://"), request)
+		defer resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	})
+}
+
+func Test_Handler_Duplicate_Request_IDs(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(r.Header.Values(internal.RequestIDHeader), "|"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []internal.Option
+		ids    []string
+		status int
+		want   string
+	}{
+		{"single", nil, []string{"abc"}, http.StatusOK, "abc"},
+		{"repeated headers", nil, []string{"abc", "def"}, http.StatusOK, "abc"},
+		{"comma separated", nil, []string{"abc, def"}, http.StatusOK, "abc"},
+		{"rejected", []internal.Option{internal.WithRejectDuplicateRequestID()}, []string{"abc", "def"}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			opts := append([]internal.Option{internal.WithLogger(log.New(&logs, "", 0))}, tt.opts...)
+
+			frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, opts...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range tt.ids {
+				req.Header.Add(internal.RequestIDHeader, id)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, string(b), tt.want)
+			}
+			if len(tt.ids) > 1 && tt.status == http.StatusOK {
+				assert.Contains(t, logs.String(), `normalized 2 X-Request-Id values to "abc"`)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Strips_Connection_Option_Headers(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "X-Foo=%q X-Bar=%q X-Keep=%q", r.Header.Get("X-Foo"), r.Header.Get("X-Bar"), r.Header.Get("X-Keep"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl))
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Foo, x-bar")
+	req.Header.Set("X-Foo", "hop")
+	req.Header.Set("X-Bar", "hop")
+	req.Header.Set("X-Keep", "end-to-end")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, string(b), `X-Foo="" X-Bar="" X-Keep="end-to-end"`)
+}
+
+func Test_Proxy_Deprecated_Routes(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer backendServer.Close()
+
+	// a base path on the target ensures matching uses the client's path, not upstream's.
+	targetUrl, err := url.Parse(backendServer.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	proxy := internal.NewProxy(targetUrl, internal.WithDeprecation(internal.Deprecation{
+		PathPrefix: "/v1/generate",
+		Since:      since,
+		Sunset:     sunset,
+		Link:       "https://docs.example.com/migrate-to-chat",
+	}))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL + "/v1/generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, resp.Header.Get("Deprecation"), fmt.Sprintf("@%d", since.Unix()))
+	assert.Equal(t, resp.Header.Get("Sunset"), "Fri, 01 Jan 2027 00:00:00 GMT")
+	assert.Equal(t, resp.Header.Get("Link"), `<https://docs.example.com/migrate-to-chat>; rel="deprecation"`)
+
+	resp, err = http.Get(frontendServer.URL + "/v1/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Empty(t, resp.Header.Get("Deprecation"))
+	assert.Empty(t, resp.Header.Get("Sunset"))
+}
+
+func Test_Live_Server_Pause_And_Resume(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl)
+	addr := strings.TrimPrefix(srv.URL(), "http://")
+
+	// a dedicated transport keeps one connection alive across the pause.
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1}, Timeout: time.Second}
+	get := func() error {
+		resp, err := client.Get(srv.URL())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	assert.NoError(t, get())
+	assert.NoError(t, srv.Pause())
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err, "new connections should be refused while paused")
+
+	// the established connection is still served.
+	assert.NoError(t, get())
+
+	assert.NoError(t, srv.Resume())
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	assert.NoError(t, err, "new connections should be accepted after resume")
+	if conn != nil {
+		conn.Close()
+	}
+
+	resp, err := http.Get(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func Test_Proxy_Upstream_Content_Length_Mismatch(t *testing.T) {
+	targetUrl := rawBackend(t, func(n int, conn *net.TCPConn) {
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		// declare more than we send, then close cleanly.
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nonly ten b")
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	var logs syncBuffer
+	reg := prometheus.NewRegistry()
+	proxy := internal.NewProxy(targetUrl, internal.WithLogger(log.New(&logs, "", 0)), internal.WithMetricsRegistry(reg))
+
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the client sees a truncated body promptly instead of hanging.
+	b, err := io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, string(b), "only ten b")
+	assert.Contains(t, logs.String(), "upstream Content-Length mismatch for GET")
+	assert.Contains(t, logs.String(), "declared 100 bytes, got 10")
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cohere_proxy_upstream_body_errors_total Upstream response bodies that ended early, by reason.
+# TYPE cohere_proxy_upstream_body_errors_total counter
+cohere_proxy_upstream_body_errors_total{reason="short"} 1
+`), "cohere_proxy_upstream_body_errors_total"))
+}
+
+func Test_Handler_Feature_Flags(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "feature header=%q", r.Header.Get(internal.FeatureHeader))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shout := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Shout", "on")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	handler := internal.NewHandler(targetUrl, internal.WithFeature("shout", shout))
+
+	frontendServer := httptest.NewServer(handler)
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name    string
+		feature string
+		want    string
+	}{
+		{"not requested", "", ""},
+		{"allowlisted", "Shout", "on"},
+		{"among others", "whisper, shout", "on"},
+		{"not allowlisted", "whisper", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.feature != "" {
+				req.Header.Set(internal.FeatureHeader, tt.feature)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.Header.Get("X-Shout"), tt.want)
+			assert.Equal(t, string(b), `feature header=""`)
+		})
+	}
+}
+
+func Test_Live_Server_Write_Timeout(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow completion")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quiet := internal.WithLogger(log.New(io.Discard, "", 0))
+
+	t.Run("short timeout cuts the response", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, quiet, internal.WithWriteTimeout(50*time.Millisecond))
+
+		resp, err := http.Get(srv.URL())
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("zero disables the timeout", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, quiet, internal.WithWriteTimeout(0))
+
+		resp, err := http.Get(srv.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, string(b), "slow completion")
+	})
+}
+
+func Test_Proxy_Strips_Referer_And_Origin(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "referer=%q origin=%q", r.Header.Get("Referer"), r.Header.Get("Origin"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []internal.Option
+		want string
+	}{
+		{"forwarded by default", nil, `referer="https://app.example.com/chat" origin="https://app.example.com"`},
+		{"referer stripped", []internal.Option{internal.WithoutReferer()}, `referer="" origin="https://app.example.com"`},
+		{"origin stripped", []internal.Option{internal.WithoutOrigin()}, `referer="https://app.example.com/chat" origin=""`},
+		{"both stripped", []internal.Option{internal.WithoutReferer(), internal.WithoutOrigin()}, `referer="" origin=""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, tt.opts...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Referer", "https://app.example.com/chat")
+			req.Header.Set("Origin", "https://app.example.com")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(b), tt.want)
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func Test_Proxy_Custom_Transport(t *testing.T) {
+	targetUrl, err := url.Parse("http://upstream.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen atomic.Int32
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seen.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("from custom transport " + req.URL.Host)),
+			Request:    req,
+		}, nil
+	})
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithTransport(rt)))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, string(b), "from custom transport upstream.invalid")
+	assert.Equal(t, seen.Load(), int32(1))
+}
+
+// writeTestCert writes the self-signed certificate httptest uses for TLS
+// servers to disk, returning the file paths and a client that trusts it.
+func writeTestCert(t *testing.T) (certFile, keyFile string, client *http.Client) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	cert := ts.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, ts.Client()
+}
+
+func Test_Live_Server_Serves_TLS(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "reverse proxied over %s", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile, client := writeTestCert(t)
+
+	srv := internal.NewServer(targetUrl)
+	assert.NoError(t, srv.Listen("127.0.0.1:0"))
+	go srv.ServeTLS(certFile, keyFile)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	// ServeTLS flips the scheme as soon as it runs.
+	assert.Eventually(t, func() bool { return strings.HasPrefix(srv.URL(), "https://") }, time.Second, time.Millisecond)
+
+	resp, err := client.Get(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, resp.TLS)
+	assert.Equal(t, string(b), "reverse proxied over https")
+}
+
+func Test_Proxy_Passes_Through_Rate_Limit_Headers(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Remaining", r.URL.Query().Get("remaining"))
+		w.Header().Set("X-RateLimit-Reset", "1700000000")
+		if r.URL.Query().Get("remaining") == "0" {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"message":"rate limited"}`)
+			return
+		}
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := internal.NewHandler(targetUrl, internal.WithErrorBodyLogging(1024), internal.WithLogger(log.New(io.Discard, "", 0)))
+
+	frontendServer := httptest.NewServer(handler)
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name       string
+		remaining  string
+		status     int
+		retryAfter string
+	}{
+		{"under limit", "42", http.StatusOK, ""},
+		{"limited", "0", http.StatusTooManyRequests, "30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(frontendServer.URL + "?remaining=" + tt.remaining)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Equal(t, resp.Header.Get("X-RateLimit-Limit"), "100")
+			assert.Equal(t, resp.Header.Get("X-RateLimit-Remaining"), tt.remaining)
+			assert.Equal(t, resp.Header.Get("X-RateLimit-Reset"), "1700000000")
+			assert.Equal(t, resp.Header.Get("Retry-After"), tt.retryAfter)
+		})
+	}
+}
+
+func Test_Live_Server_Request_Deadline(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			io.Copy(io.Discard, r.Body)
+		case "/slow-headers":
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		case "/slow-body":
+			fmt.Fprint(w, "partial")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	srv := newLiveServer(t, targetUrl, internal.WithRequestDeadline(100*time.Millisecond), internal.WithLogger(log.New(logs, "", 0)))
+	addr := strings.TrimPrefix(srv.URL(), "http://")
+
+	t.Run("fast request completes", func(t *testing.T) {
+		resp, err := http.Get(srv.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, string(b), "done")
+	})
+
+	t.Run("client stalls uploading the body", func(t *testing.T) {
+		start := time.Now()
+		resp := rawRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\nhello")
+		defer resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusGatewayTimeout)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("upstream stalls before headers", func(t *testing.T) {
+		start := time.Now()
+		resp, err := http.Get(srv.URL() + "/slow-headers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		assert.Equal(t, resp.StatusCode, http.StatusGatewayTimeout)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("upstream stalls mid-body", func(t *testing.T) {
+		start := time.Now()
+		resp, err := http.Get(srv.URL() + "/slow-body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// headers are already out, so the response is cut short instead.
+		b, err := io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		assert.Equal(t, string(b), "partial")
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+}
+
+func Test_Proxy_Injects_API_Key(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []internal.Option
+		client string
+		want   string
+	}{
+		{"injected", []internal.Option{internal.WithAPIKey("server-key")}, "", "Bearer server-key"},
+		{"client key kept", []internal.Option{internal.WithAPIKey("server-key")}, "Bearer client-key", "Bearer client-key"},
+		{"forced over client key", []internal.Option{internal.WithAPIKey("server-key"), internal.WithForceAPIKey(true)}, "Bearer client-key", "Bearer server-key"},
+		{"not forced", []internal.Option{internal.WithAPIKey("server-key"), internal.WithForceAPIKey(false)}, "Bearer client-key", "Bearer client-key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, tt.opts...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.client != "" {
+				req.Header.Set("Authorization", tt.client)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(b), tt.want)
+		})
+	}
+}
+
+func Test_Proxy_Retries_Unavailable_Upstream(t *testing.T) {
+	var hits atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first two attempts of every request.
+		if hits.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "recovered")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl, internal.WithRetry(3, time.Millisecond), internal.WithLogger(log.New(io.Discard, "", 0)))
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		idempotencyKey string
+		status         int
+		retries        string
+		hits           int32
+	}{
+		{"get", http.MethodGet, "", "", http.StatusOK, "2", 3},
+		{"post", http.MethodPost, "", "", http.StatusServiceUnavailable, "", 1},
+		{"post with idempotency key", http.MethodPost, "", "abc", http.StatusOK, "2", 3},
+		{"post with unbuffered body", http.MethodPost, `{"prompt": "hello"}`, "abc", http.StatusServiceUnavailable, "", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, frontendServer.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.idempotencyKey != "" {
+				req.Header.Set(internal.IdempotencyKeyHeader, tt.idempotencyKey)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Equal(t, resp.Header.Get(internal.ProxyRetriesHeader), tt.retries)
+			assert.Equal(t, hits.Load(), tt.hits)
+		})
+	}
+}
+
+func Test_Proxy_Retries_Connection_Refused(t *testing.T) {
+	// grab a free port, then close it so connections are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	targetUrl, err := url.Parse("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithRetry(3, time.Millisecond), internal.WithLogger(log.New(logs, "", 0))))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+	assert.Equal(t, strings.Count(logs.String(), "upstream unavailable for GET"), 2)
+}
+
+func Test_Handler_Counts_Prompt_Tokens(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// read it all before echoing it, as HTTP/1 can't do both at once.
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{
+		"model": "command",
+		"preamble": "You are a helpful assistant.",
+		"chat_history": [
+			{"role": "USER", "message": "What is the capital of France?"},
+			{"role": "CHATBOT", "message": "The capital of France is Paris."}
+		],
+		"message": "And what is its population?"
+	}`
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		// 28, 30, 31 and 27 characters of prompt text, at ~4 characters per token.
+		{"default fields", nil, "~30 prompt tokens"},
+		{"configured fields", []string{"message"}, "~7 prompt tokens"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &syncBuffer{}
+			handler := internal.NewHandler(targetUrl, internal.WithTokenCounting(tt.fields...), internal.WithLogger(log.New(logs, "", 0)))
+
+			frontendServer := httptest.NewServer(handler)
+			defer frontendServer.Close()
+
+			resp, err := http.Post(frontendServer.URL+"/v1/chat", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, string(b), body)
+			assert.Contains(t, logs.String(), "request POST /v1/chat: "+tt.want)
+		})
+	}
+
+	t.Run("too large to count", func(t *testing.T) {
+		logs := &syncBuffer{}
+		handler := internal.NewHandler(targetUrl, internal.WithTokenCounting(), internal.WithLogger(log.New(logs, "", 0)))
+
+		frontendServer := httptest.NewServer(handler)
+		defer frontendServer.Close()
+
+		large := `{"message": "` + strings.Repeat("a", 8<<20) + `"}`
+		// hide the length, so the cap has to catch it while reading.
+		resp, err := http.Post(frontendServer.URL+"/v1/chat", "application/json", io.MultiReader(strings.NewReader(large)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, len(b), len(large))
+		assert.NotContains(t, logs.String(), "prompt tokens")
+	})
+}
+
+func Test_Proxy_Respects_Retry_After(t *testing.T) {
+	var hits atomic.Int32
+	var retryAfter atomic.Value
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// rate limit every other request.
+		if hits.Add(1)%2 == 1 {
+			w.Header().Set("Retry-After", retryAfter.Load().(string))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithRespectRetryAfter(true),
+		internal.WithRetryAfterMaxWait(time.Second),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		status     int
+		hits       int32
+	}{
+		{"seconds", "0", http.StatusOK, 2},
+		{"http date", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), http.StatusOK, 2},
+		{"past the max wait", "3600", http.StatusTooManyRequests, 1},
+		{"unparseable", "soon", http.StatusTooManyRequests, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits.Store(0)
+			retryAfter.Store(tt.retryAfter)
+
+			resp, err := http.Get(frontendServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Equal(t, hits.Load(), tt.hits)
+			if tt.status == http.StatusTooManyRequests {
+				assert.Equal(t, resp.Header.Get("Retry-After"), tt.retryAfter)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Caps_Immediate_Retry_After(t *testing.T) {
+	var hits atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl,
+		internal.WithRespectRetryAfter(true),
+		internal.WithRetryAfterMaxWait(time.Minute),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the first attempt, then a handful of retries, not a tight loop.
+	assert.Equal(t, resp.StatusCode, http.StatusTooManyRequests)
+	assert.Equal(t, hits.Load(), int32(6))
+}
+
+func Test_Live_Server_Health_Endpoint(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			forwarded.Add(1)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quiet := internal.WithLogger(log.New(io.Discard, "", 0))
+	check := internal.WithUpstreamHealthCheck("/ping", 100*time.Millisecond)
+
+	defaultPath := newLiveServer(t, targetUrl, quiet, check)
+	customPath := newLiveServer(t, targetUrl, quiet, check, internal.WithHealthPath("/ready"))
+	disabled := newLiveServer(t, targetUrl, quiet, internal.WithHealthPath(""))
+
+	status := func(u string) int {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, status(defaultPath.URL()+"/healthz"), http.StatusOK)
+	assert.Equal(t, status(customPath.URL()+"/ready"), http.StatusOK)
+	assert.Equal(t, forwarded.Load(), int32(0))
+
+	// without a health endpoint, the path is just proxied.
+	assert.Equal(t, status(disabled.URL()+"/healthz"), http.StatusOK)
+	assert.Equal(t, forwarded.Load(), int32(1))
+
+	backendServer.Close()
+	assert.Equal(t, status(defaultPath.URL()+"/healthz"), http.StatusServiceUnavailable)
+	assert.Equal(t, status(customPath.URL()+"/ready"), http.StatusServiceUnavailable)
+}
+
+func Test_Proxy_Normalizes_Duplicate_Content_Type(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = []string{"application/json", "text/plain"}
+		fmt.Fprint(w, `{"text":"hello"}`)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithLogger(log.New(logs, "", 0))))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL + "/v1/generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, resp.Header.Values("Content-Type"), []string{"application/json"})
+	assert.Contains(t, logs.String(), `normalized 2 Content-Type values from upstream for GET`)
+	assert.Contains(t, logs.String(), `/v1/generate to "application/json"`)
+}
+
+func Test_Live_Server_Metrics(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	srv := newLiveServer(t, targetUrl, internal.WithMetricsRegistry(reg))
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := http.Get(srv.URL() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cohere_proxy_requests_total Requests handled by the proxy, by method and response status.
+# TYPE cohere_proxy_requests_total counter
+cohere_proxy_requests_total{method="GET",status="200"} 2
+cohere_proxy_requests_total{method="GET",status="404"} 1
+`), "cohere_proxy_requests_total"))
+
+	// one series per status class.
+	latency, err := testutil.GatherAndCount(reg, "cohere_proxy_upstream_latency_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, latency, 2)
+
+	resp, err := http.Get(srv.URL() + internal.MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Contains(t, string(b), `cohere_proxy_requests_total{method="GET",status="404"} 1`)
+	// the scrape itself is served locally, not proxied or counted.
+	assert.Equal(t, forwarded.Load(), int32(3))
+}
+
+func Test_Live_Server_Static_Responses(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	robots := "User-agent: *\nDisallow: /\n"
+	srv := newLiveServer(t, targetUrl,
+		internal.WithStaticResponse("/robots.txt", "text/plain; charset=utf-8", robots),
+		internal.WithStaticResponse("/.well-known/security.txt", "text/plain", "Contact: mailto:security@example.com\n"),
+	)
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(srv.URL() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, body := get("/robots.txt")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, body, robots)
+
+	_, body = get("/.well-known/security.txt")
+	assert.Equal(t, body, "Contact: mailto:security@example.com\n")
+	assert.Equal(t, forwarded.Load(), int32(0))
+
+	_, body = get("/robots.txt.bak")
+	assert.Equal(t, body, "reverse proxied")
+	assert.Equal(t, forwarded.Load(), int32(1))
+}
+
+func Test_Live_Server_Per_Upstream_Health_Checks(t *testing.T) {
+	var primaryStatus, secondaryStatus atomic.Int32
+	primaryStatus.Store(http.StatusOK)
+	secondaryStatus.Store(http.StatusNoContent)
+
+	healthBackend := func(path string, status *atomic.Int32) *url.URL {
+		backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(int(status.Load()))
+		}))
+		t.Cleanup(backendServer.Close)
+
+		u, err := url.Parse(backendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	primary := healthBackend("/health", &primaryStatus)
+	secondary := healthBackend("/status", &secondaryStatus)
+
+	balancer := internal.NewAdaptiveBalancer(
+		internal.WeightedTarget{URL: primary, HealthCheckPath: "/health", HealthyStatus: http.StatusOK},
+		internal.WeightedTarget{URL: secondary, HealthCheckPath: "/status", HealthyStatus: http.StatusNoContent},
+	)
+	srv := newLiveServer(t, primary, internal.WithBalancer(balancer), internal.WithLogger(log.New(io.Discard, "", 0)))
+
+	healthz := func() int {
+		resp, err := http.Get(srv.URL() + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, healthz(), http.StatusOK)
+
+	// the secondary is healthy on its own path and status.
+	primaryStatus.Store(http.StatusServiceUnavailable)
+	assert.Equal(t, healthz(), http.StatusOK)
+
+	// a 200 isn't the 204 the secondary is expected to answer with.
+	secondaryStatus.Store(http.StatusOK)
+	assert.Equal(t, healthz(), http.StatusServiceUnavailable)
+}
+
+func Test_Handler_Access_Log(t *testing.T) {
+	events := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-events
+			fmt.Fprint(w, "data: hello\n\n")
+			w.(http.Flusher).Flush()
+			<-events
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	handler := internal.NewHandler(targetUrl, internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, nil))))
+
+	frontendServer := httptest.NewServer(handler)
+	defer frontendServer.Close()
+
+	resp, err := http.Post(frontendServer.URL+"/v1/generate", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var entry struct {
+		Msg     string
+		Method  string
+		Path    string
+		Status  int
+		Bytes   int64
+		Latency int64
+		Client  string
+	}
+	assert.NoError(t, json.Unmarshal([]byte(logs.String()), &entry))
+	assert.Equal(t, entry.Msg, "request")
+	assert.Equal(t, entry.Method, http.MethodPost)
+	assert.Equal(t, entry.Path, "/v1/generate")
+	assert.Equal(t, entry.Status, http.StatusCreated)
+	assert.Equal(t, entry.Bytes, int64(len("reverse proxied")))
+	assert.Greater(t, entry.Latency, int64(0))
+	assert.Equal(t, entry.Client, "127.0.0.1")
+
+	// streamed events still reach the client while the upstream holds the stream open.
+	resp, err = http.Get(frontendServer.URL + "/v1/chat/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	events <- struct{}{}
+	line := make(chan string)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		assert.Equal(t, l, "data: hello\n")
+	case <-time.After(time.Second):
+		t.Fatal("event was not flushed to the client")
+	}
+	close(events)
+}
+
+func Test_Handler_Access_Log_Levels(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status int
+		level  string
+	}{
+		{http.StatusOK, "INFO"},
+		{http.StatusFound, "INFO"},
+		{http.StatusNotFound, "WARN"},
+		{http.StatusTooManyRequests, "WARN"},
+		{http.StatusInternalServerError, "ERROR"},
+		{http.StatusServiceUnavailable, "ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			logs := &syncBuffer{}
+			frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+				internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, nil))),
+				internal.WithLogger(log.New(io.Discard, "", 0)),
+			))
+			defer frontendServer.Close()
+
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := client.Get(frontendServer.URL + "/" + strconv.Itoa(tt.status))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			var entry struct {
+				Level  string
+				Status int
+			}
+			assert.NoError(t, json.Unmarshal([]byte(logs.String()), &entry))
+			assert.Equal(t, entry.Status, tt.status)
+			assert.Equal(t, entry.Level, tt.level)
+		})
+	}
+}
+
+func Test_Live_Server_Listener_Files_Survive_Shutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("listener file descriptors aren't supported on windows")
+	}
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl)
+	address := srv.URL()
+
+	files, err := srv.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, 1)
+	defer files[0].Close()
+
+	// the original server going away must not close the socket.
+	assert.NoError(t, srv.Shutdown(context.Background()))
+
+	// stand in for the restarted process taking over the socket.
+	listener, err := net.FileListener(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, internal.NewHandler(targetUrl))
+	defer listener.Close()
+
+	resp, err := http.Get(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(b), "reverse proxied")
+}
+
+func Test_Proxy_JSON_Error_Responses(t *testing.T) {
+	// grab a free port, then close it so connections are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedUrl, err := url.Parse("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slowServer.Close()
+
+	slowUrl, err := url.Parse(slowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quiet := internal.WithLogger(log.New(io.Discard, "", 0))
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "connection refused",
+			handler:     internal.NewHandler(refusedUrl, quiet),
+			status:      http.StatusBadGateway,
+			contentType: "application/json",
+			body:        `{"error":{"message":"the upstream could not be reached","type":"upstream_unavailable"}}` + "\n",
+		},
+		{
+			name:        "timeout",
+			handler:     internal.NewHandler(slowUrl, quiet, internal.WithRequestDeadline(50*time.Millisecond)),
+			status:      http.StatusGatewayTimeout,
+			contentType: "application/json",
+			body:        `{"error":{"message":"the upstream did not respond in time","type":"upstream_timeout"}}` + "\n",
+		},
+		{
+			name: "custom handler",
+			handler: internal.NewHandler(refusedUrl, quiet, internal.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+				http.Error(w, "try again later", http.StatusServiceUnavailable)
+			})),
+			status:      http.StatusServiceUnavailable,
+			contentType: "text/plain; charset=utf-8",
+			body:        "try again later\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(tt.handler)
+			defer frontendServer.Close()
+
+			resp, err := http.Get(frontendServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Equal(t, resp.Header.Get("Content-Type"), tt.contentType)
+			assert.Equal(t, string(b), tt.body)
+		})
+	}
+}
+
+func Test_Live_Server_Forwards_Large_Headers(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl, internal.WithMaxHeaderBytes(64<<10))
+
+	tests := []struct {
+		name   string
+		size   int
+		status int
+	}{
+		// well past the typical 8KB limits of other proxies.
+		{"within limit", 48 << 10, http.StatusOK},
+		{"over limit", 128 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := "Bearer " + strings.Repeat("a", tt.size)
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", token)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, string(b), token)
+			}
+		})
+	}
+}
+
+func Test_Proxy_Flush_Interval_Immediate(t *testing.T) {
+	written := make(chan time.Time)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// not text/event-stream, which ReverseProxy always flushes immediately.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "{\"token\":%d}\n", i)
+			w.(http.Flusher).Flush()
+			written <- time.Now()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithFlushInterval(-1)))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	for i := 0; i < 3; i++ {
+		sent := <-written
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, line, fmt.Sprintf("{\"token\":%d}\n", i))
+		// well under the backend's 50ms gap between chunks.
+		assert.Less(t, time.Since(sent), 25*time.Millisecond)
+	}
+}
+
+func Test_Handler_Broadcasts_Stream_To_Subscribers(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	events := make(chan string)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithBroadcast()))
+	defer frontendServer.Close()
+
+	subscribe := func() *bufio.Reader {
+		req, err := http.NewRequest(http.MethodGet, frontendServer.URL+"/v1/chat/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(internal.BroadcastHeader, "stream-1")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+		return bufio.NewReader(resp.Body)
+	}
+
+	subscribers := []*bufio.Reader{subscribe(), subscribe()}
+
+	for _, event := range []string{"hello", "world"} {
+		events <- event
+		for _, sub := range subscribers {
+			line, err := sub.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, line, "data: "+event+"\n")
+			sub.ReadString('\n')
+		}
+	}
+	close(events)
+
+	// both streams end with the upstream's.
+	for _, sub := range subscribers {
+		_, err := sub.ReadString('\n')
+		assert.Equal(t, err, io.EOF)
+	}
+	assert.Equal(t, upstreamRequests.Load(), int32(1))
+}
+
+func Test_Handler_Broadcast_Failures_And_Credentials(t *testing.T) {
+	var upstreamRequests atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		if r.URL.Path == "/v1/broken" {
+			// promises more than it sends, then hangs up.
+			w.Header().Set("Content-Length", "1000")
+			fmt.Fprint(w, "data: partial\n\n")
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithBroadcast(),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	defer frontendServer.Close()
+
+	subscribe := func(path, auth string) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, frontendServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(internal.BroadcastHeader, "stream-1")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	// an upstream failing midway isn't passed off as the end of the stream.
+	_, err = subscribe("/v1/broken", "")
+	assert.Error(t, err)
+
+	// subscribers with different credentials don't share a stream.
+	body, err := subscribe("/v1/stream", "Bearer alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer alice", body)
+	body, err = subscribe("/v1/stream", "Bearer bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer bob", body)
+	assert.Equal(t, int32(3), upstreamRequests.Load())
+}
+
+func Test_Handler_Rate_Limits_Per_Client(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithRateLimit(0.5, 2)))
+	defer frontendServer.Close()
+
+	get := func(auth string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	// a key counts against the client's IP until the upstream accepts it. from
+	// then on, it has its own limit: the burst is allowed, then it's cut off.
+	assert.Equal(t, get("Bearer noisy").StatusCode, http.StatusOK)
+	assert.Equal(t, get("Bearer noisy").StatusCode, http.StatusOK)
+	assert.Equal(t, get("Bearer noisy").StatusCode, http.StatusOK)
+	limited := get("Bearer noisy")
+	assert.Equal(t, limited.StatusCode, http.StatusTooManyRequests)
+	assert.Equal(t, limited.Header.Get("Retry-After"), "2")
+	assert.Equal(t, limited.Header.Get("Content-Type"), "application/json")
+
+	// so made-up keys share the IP's limit rather than each getting a fresh one.
+	assert.Equal(t, get("Bearer quiet").StatusCode, http.StatusOK)
+	assert.Equal(t, get("").StatusCode, http.StatusTooManyRequests)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, get(fmt.Sprintf("Bearer random-%d", i)).StatusCode, http.StatusTooManyRequests)
+	}
+
+	assert.Equal(t, forwarded.Load(), int32(4))
+}
+
+func Test_Live_Server_Rate_Limits_Survive_Restart(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []internal.Option{
+		internal.WithRateLimit(0.01, 2),
+		internal.WithRateLimitStateFile(filepath.Join(t.TempDir(), "ratelimits.json")),
+	}
+
+	get := func(srv *internal.Server, auth string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// spend both the IP's burst and, once the upstream accepts it, the key's.
+	srv := newLiveServer(t, targetUrl, opts...)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, get(srv, "Bearer known"), http.StatusOK)
+	}
+	assert.Equal(t, get(srv, "Bearer known"), http.StatusTooManyRequests)
+	assert.Equal(t, get(srv, ""), http.StatusOK)
+	assert.Equal(t, get(srv, ""), http.StatusTooManyRequests)
+	assert.NoError(t, srv.Shutdown(context.Background()))
+
+	restarted := newLiveServer(t, targetUrl, opts...)
+	assert.Equal(t, get(restarted, "Bearer known"), http.StatusTooManyRequests)
+	assert.Equal(t, get(restarted, ""), http.StatusTooManyRequests)
+
+	// without the state file, everyone starts afresh.
+	fresh := newLiveServer(t, targetUrl, internal.WithRateLimit(0.01, 2))
+	assert.Equal(t, get(fresh, ""), http.StatusOK)
+}
+
+func Test_Handler_Rate_Limits_Unforwarded_Keys_By_IP(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's key is replaced, so the upstream never vouches for it.
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithRateLimit(0.5, 2),
+		internal.WithAPIKey("upstream-key"),
+		internal.WithForceAPIKey(true),
+	))
+	defer frontendServer.Close()
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer client")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+}
+
+func Test_Proxy_First_Byte_Timeout(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stalled" {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		fmt.Fprint(w, "data: hello\n\n")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := internal.NewProxy(targetUrl, internal.WithFirstByteTimeout(100*time.Millisecond), internal.WithLogger(log.New(io.Discard, "", 0)))
+	frontendServer := httptest.NewServer(proxy)
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{"prompt body", "/", http.StatusOK, "data: hello\n\n"},
+		{"stalled body", "/stalled", http.StatusGatewayTimeout, `{"error":{"message":"the upstream did not respond in time","type":"upstream_timeout"}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp, err := http.Get(frontendServer.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			assert.Equal(t, string(b), tt.body)
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func Test_Handler_Sheds_Load_Over_Max_Concurrent(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream" {
+			return
+		}
+		// stream until the client goes away.
+		for {
+			fmt.Fprint(w, "data: tick\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithMaxConcurrent(1),
+		internal.WithQueueTimeout(50*time.Millisecond),
+		internal.WithMetricsRegistry(reg),
+	))
+	defer frontendServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, frontendServer.URL+"/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if _, err := stream.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cohere_proxy_in_flight_requests Requests currently holding one of the proxy's concurrency slots.
+# TYPE cohere_proxy_in_flight_requests gauge
+cohere_proxy_in_flight_requests 1
+`), "cohere_proxy_in_flight_requests"))
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusServiceUnavailable)
+	assert.Equal(t, resp.Header.Get("Retry-After"), "1")
+	assert.Contains(t, string(b), `"type":"overloaded"`)
+
+	// disconnecting mid-stream frees the slot.
+	cancel()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	// the slot is released just after the response is written.
+	assert.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cohere_proxy_in_flight_requests Requests currently holding one of the proxy's concurrency slots.
+# TYPE cohere_proxy_in_flight_requests gauge
+cohere_proxy_in_flight_requests 0
+`), "cohere_proxy_in_flight_requests") == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_Handler_Limits_Queued_Requests_Per_Client(t *testing.T) {
+	holding := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case holding <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithMaxConcurrent(1),
+		internal.WithQueueTimeout(5*time.Second),
+		internal.WithMaxQueuedPerClient(1),
+		internal.WithTrustedProxies([]string{"127.0.0.0/8"}),
+	))
+	defer frontendServer.Close()
+
+	get := func(client string) <-chan int {
+		status := make(chan int, 1)
+		go func() {
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Error(err)
+				status <- 0
+				return
+			}
+			req.Header.Set("X-Forwarded-For", client)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		return status
+	}
+
+	// the first request takes the only slot.
+	first := get("203.0.113.1")
+	<-holding
+
+	// of two more from the same client, one may wait and the other is rejected.
+	second, third := get("203.0.113.1"), get("203.0.113.1")
+	var waiting <-chan int
+	select {
+	case status := <-second:
+		assert.Equal(t, status, http.StatusTooManyRequests)
+		waiting = third
+	case status := <-third:
+		assert.Equal(t, status, http.StatusTooManyRequests)
+		waiting = second
+	case <-time.After(5 * time.Second):
+		t.Fatal("neither queued request was rejected")
+	}
+
+	// another client still gets a place in the queue.
+	other := get("198.51.100.1")
+	select {
+	case status := <-other:
+		t.Fatalf("other client wasn't queued, got %d", status)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, <-first, http.StatusOK)
+	assert.Equal(t, <-waiting, http.StatusOK)
+	assert.Equal(t, <-other, http.StatusOK)
+}
+
+func Test_Proxy_Logs_Header_Diffs(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = []string{"application/json", "text/plain"}
+		fmt.Fprint(w, `{"text":"hello"}`)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []internal.Option
+		logged  []string
+		missing []string
+	}{
+		{
+			name: "enabled",
+			opts: []internal.Option{internal.WithHeaderDiffLogging()},
+			logged: []string{
+				"request headers for GET /v1/chat: +Authorization: [redacted], -Referer, +X-Forwarded-For: 127.0.0.1, ",
+				"+X-Forwarded-Proto: http\n",
+				"response headers for GET /v1/chat: ~Content-Type: application/json, text/plain -> application/json\n",
+			},
+			missing: []string{"secret"},
+		},
+		{
+			name:    "disabled",
+			missing: []string{"headers for"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := &syncBuffer{}
+			opts := append([]internal.Option{internal.WithAPIKey("secret"), internal.WithoutReferer(), internal.WithLogger(log.New(logs, "", 0))}, tt.opts...)
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, opts...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL+"/v1/chat", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Referer", "https://example.com/")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			for _, s := range tt.logged {
+				assert.Contains(t, logs.String(), s)
+			}
+			for _, s := range tt.missing {
+				assert.NotContains(t, logs.String(), s)
+			}
+		})
+	}
+}
+
+func Test_Live_Server_Ejects_Failing_Upstreams(t *testing.T) {
+	goodServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer goodServer.Close()
+	deadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadServer.Close()
+
+	goodUrl, err := url.Parse(goodServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadUrl, err := url.Parse(deadServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// heavily weighted, so it keeps being picked despite the failure penalty
+	// until it's ejected.
+	balancer := internal.NewAdaptiveBalancer(
+		internal.WeightedTarget{URL: goodUrl, Weight: 1},
+		internal.WeightedTarget{URL: deadUrl, Weight: 1000},
+	)
+	reg := prometheus.NewRegistry()
+	srv := newLiveServer(t, goodUrl,
+		internal.WithBalancer(balancer),
+		internal.WithEjectionThreshold(2),
+		internal.WithEjectionDuration(200*time.Millisecond),
+		internal.WithMetricsRegistry(reg),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	)
+
+	statuses := map[int]int{}
+	for i := 0; i < 30; i++ {
+		resp, err := http.Get(srv.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statuses[resp.StatusCode]++
+	}
+
+	// the dead upstream fails twice at most before it's taken out of rotation.
+	assert.LessOrEqual(t, statuses[http.StatusBadGateway], 2)
+	assert.Equal(t, balancer.Ejected(), []*url.URL{deadUrl})
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP cohere_proxy_upstream_ejected Whether the upstream target is ejected from rotation after repeated failures.
+# TYPE cohere_proxy_upstream_ejected gauge
+cohere_proxy_upstream_ejected{target=%q} 1
+cohere_proxy_upstream_ejected{target=%q} 0
+`, deadUrl, goodUrl)), "cohere_proxy_upstream_ejected"))
+
+	// and comes back once the ejection expires.
+	assert.Eventually(t, func() bool { return len(balancer.Ejected()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_Proxy_Falls_Back_When_All_Upstreams_Ejected(t *testing.T) {
+	deadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadServer.Close()
+
+	deadUrl, err := url.Parse(deadServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer := internal.NewAdaptiveBalancer(internal.WeightedTarget{URL: deadUrl, Weight: 1})
+	frontendServer := httptest.NewServer(internal.NewProxy(deadUrl,
+		internal.WithBalancer(balancer),
+		internal.WithEjectionThreshold(1),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	defer frontendServer.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(frontendServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// still tried, rather than failing fast.
+		assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+		assert.Equal(t, balancer.Ejected(), []*url.URL{deadUrl})
+	}
+}
+
+func Test_Proxy_Per_Upstream_Concurrency_Cap(t *testing.T) {
+	var weakCount, strongCount atomic.Int32
+	release := make(chan struct{})
+	weakServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		weakCount.Add(1)
+		<-release
+	}))
+	defer weakServer.Close()
+	strongServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		strongCount.Add(1)
+	}))
+	defer strongServer.Close()
+
+	weakUrl, err := url.Parse(weakServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strongUrl, err := url.Parse(strongServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the weak upstream would get nearly everything, if not for its cap.
+	balancer := internal.NewAdaptiveBalancer(
+		internal.WeightedTarget{URL: weakUrl, Weight: 1000, MaxConcurrent: 1},
+		internal.WeightedTarget{URL: strongUrl, Weight: 1},
+	)
+	frontendServer := httptest.NewServer(internal.NewProxy(weakUrl, internal.WithBalancer(balancer)))
+	defer frontendServer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(frontendServer.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		}()
+	}
+
+	assert.Eventually(t, func() bool { return weakCount.Load()+strongCount.Load() == 10 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, weakCount.Load(), int32(1))
+	assert.Equal(t, strongCount.Load(), int32(9))
+
+	close(release)
+	wg.Wait()
+}
+
+func Test_Handler_Retries_Buffered_Post_Bodies(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, fmt.Sprintf("%d %s", r.ContentLength, b))
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithRetry(3, time.Millisecond),
+		internal.WithBufferedBody(16),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		received []string
+	}{
+		{"under the cap", `{"prompt":"hi"}`, http.StatusOK, []string{`15 {"prompt":"hi"}`, `15 {"prompt":"hi"}`}},
+		{"over the cap", `{"prompt":"hello there"}`, http.StatusServiceUnavailable, []string{`-1 {"prompt":"hello there"}`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			received = nil
+			mu.Unlock()
+
+			// hide the length, so the upload is chunked.
+			resp, err := http.Post(frontendServer.URL+"/v1/generate", "application/json", io.NopCloser(strings.NewReader(tt.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, received, tt.received)
+		})
+	}
+}
+
+func Test_Handler_Limits_Body_Sizes(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		switch r.URL.Path {
+		case "/declared":
+			w.Header().Set("Content-Length", "100")
+			w.Write(bytes.Repeat([]byte("a"), 100))
+		case "/streamed":
+			for i := 0; i < 10; i++ {
+				w.Write(bytes.Repeat([]byte("a"), 10))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write(b)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithMaxRequestBytes(10),
+		internal.WithMaxResponseBytes(50),
+		internal.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		body   io.Reader
+		status int
+		// errorType is the JSON error type expected in the response, if any.
+		errorType string
+	}{
+		{name: "small request", path: "/", body: strings.NewReader("hello"), status: http.StatusOK},
+		{name: "declared large request", path: "/", body: strings.NewReader(strings.Repeat("a", 20)), status: http.StatusRequestEntityTooLarge, errorType: "request_too_large"},
+		{name: "chunked large request", path: "/", body: io.NopCloser(strings.NewReader(strings.Repeat("a", 20))), status: http.StatusRequestEntityTooLarge, errorType: "request_too_large"},
+		{name: "declared large response", path: "/declared", body: http.NoBody, status: http.StatusBadGateway, errorType: "response_too_large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(frontendServer.URL+tt.path, "text/plain", tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, resp.StatusCode, tt.status)
+			if tt.errorType != "" {
+				assert.Contains(t, string(b), fmt.Sprintf(`"type":%q`, tt.errorType))
+			}
+		})
+	}
+
+	t.Run("streamed large response", func(t *testing.T) {
+		resp, err := http.Get(frontendServer.URL + "/streamed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// headers are already sent, so the stream is cut off after the limit.
+		b, err := io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		assert.LessOrEqual(t, len(b), 50)
+	})
+}
+
+func Test_Proxy_Summary_Trailers(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"abc"}`)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []internal.Option
+		trailers []string
+	}{
+		{"all", []internal.Option{internal.WithSummaryTrailers()}, []string{internal.UpstreamDurationTrailer, internal.UpstreamStatusTrailer, internal.UpstreamBytesTrailer}},
+		{"chosen", []internal.Option{internal.WithSummaryTrailers(internal.UpstreamStatusTrailer)}, []string{internal.UpstreamStatusTrailer}},
+		{"none", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, tt.opts...))
+			defer frontendServer.Close()
+
+			resp, err := http.Get(frontendServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(b), `{"id":"abc"}`)
+
+			// trailers arrive once the body has been read.
+			assert.Len(t, resp.Trailer, len(tt.trailers))
+			for _, name := range tt.trailers {
+				assert.NotEmpty(t, resp.Trailer.Get(name))
+			}
+			if len(tt.trailers) == 3 {
+				assert.Equal(t, resp.Trailer.Get(internal.UpstreamStatusTrailer), "201")
+				assert.Equal(t, resp.Trailer.Get(internal.UpstreamBytesTrailer), "12")
+				assert.Regexp(t, `^\d+\.\d{3}$`, resp.Trailer.Get(internal.UpstreamDurationTrailer))
+			}
+		})
+	}
+}
+
+func Test_Handler_Answers_CORS_Options_Locally(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		w.Header().Set("X-Method", r.Method)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithCORS(internal.CORSPolicy{
+		PathPrefix:     "/v1/",
+		AllowedOrigins: []string{"https://app.example"},
+		MaxAge:         time.Hour,
+	})))
+	defer frontendServer.Close()
+
+	do := func(method, path string, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, frontendServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	preflight := http.Header{
+		"Origin":                         {"https://app.example"},
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"authorization, content-type"},
+	}
+
+	resp := do(http.MethodOptions, "/v1/chat", preflight)
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://app.example")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Methods"), "GET, POST")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Headers"), "authorization, content-type")
+	assert.Equal(t, resp.Header.Get("Access-Control-Max-Age"), "3600")
+	assert.Equal(t, forwarded.Load(), int32(0))
+
+	// other origins get no CORS headers.
+	resp = do(http.MethodOptions, "/v1/chat", http.Header{"Origin": {"https://evil.example"}, "Access-Control-Request-Method": {"POST"}})
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, forwarded.Load(), int32(0))
+
+	// the actual request is forwarded, with the proxy's CORS headers.
+	resp = do(http.MethodPost, "/v1/chat", http.Header{"Origin": {"https://app.example"}})
+	assert.Equal(t, resp.Header.Get("X-Method"), "POST")
+	assert.Equal(t, resp.Header.Values("Access-Control-Allow-Origin"), []string{"https://app.example"})
+
+	// outside the policy, OPTIONS goes upstream.
+	resp = do(http.MethodOptions, "/healthz", preflight)
+	assert.Equal(t, resp.Header.Get("X-Method"), "OPTIONS")
+	assert.Equal(t, resp.Header.Get("Access-Control-Allow-Origin"), "https://upstream.example")
+	assert.Equal(t, forwarded.Load(), int32(2))
+}
+
+func Test_Proxy_Strips_Configured_Headers(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "cohere-internal/1.2")
+		w.Header().Set("X-Request-Cost", "3")
+		fmt.Fprintf(w, "secret=%q trace=%q", r.Header.Get("X-Internal-Secret"), r.Header.Get("X-Trace"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl,
+		internal.WithStripRequestHeaders("x-internal-secret"),
+		internal.WithStripResponseHeaders("SERVER"),
+	))
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Internal-Secret", "hunter2")
+	req.Header.Set("X-Trace", "abc")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(b), `secret="" trace="abc"`)
+	assert.Empty(t, resp.Header.Get("Server"))
+	assert.Equal(t, resp.Header.Get("X-Request-Cost"), "3")
+}
+
+func Test_Handler_Request_IDs(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Correlation-Id"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithRequestID(),
+		internal.WithRequestIDHeader("X-Correlation-Id"),
+		internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, nil))),
+	))
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"generated", ""},
+		{"from client", "client-chosen-id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.id != "" {
+				req.Header.Set("X-Correlation-Id", tt.id)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			forwarded, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := resp.Header.Get("X-Correlation-Id")
+			if tt.id != "" {
+				assert.Equal(t, id, tt.id)
+			} else {
+				assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+			}
+			assert.Equal(t, string(forwarded), id)
+			assert.Contains(t, logs.String(), fmt.Sprintf(`"request_id":%q`, id))
+		})
+	}
+}
+
+func Test_Proxy_Transforms_Request_Bodies(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upper := func(body io.Reader) io.Reader {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+		}
+		return bytes.NewReader(bytes.ToUpper(b))
+	}
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithRequestBodyTransformer(upper)))
+	defer frontendServer.Close()
+
+	resp, err := http.Post(frontendServer.URL, "text/plain", strings.NewReader("hello, cohere"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(b), "HELLO, COHERE")
+}
+
+func Test_Handler_Body_Size_Histograms(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, strings.Repeat("b", 500))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithMetricsRegistry(reg),
+		internal.WithBodySizeBuckets(10, 100, 1000),
+	))
+	defer frontendServer.Close()
+
+	resp, err := http.Post(frontendServer.URL, "text/plain", strings.NewReader(strings.Repeat("a", 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cohere_proxy_request_body_bytes Size of request bodies read from clients, by method.
+# TYPE cohere_proxy_request_body_bytes histogram
+cohere_proxy_request_body_bytes_bucket{method="POST",le="10"} 0
+cohere_proxy_request_body_bytes_bucket{method="POST",le="100"} 1
+cohere_proxy_request_body_bytes_bucket{method="POST",le="1000"} 1
+cohere_proxy_request_body_bytes_bucket{method="POST",le="+Inf"} 1
+cohere_proxy_request_body_bytes_sum{method="POST"} 50
+cohere_proxy_request_body_bytes_count{method="POST"} 1
+# HELP cohere_proxy_response_body_bytes Size of response bodies written to clients, by method.
+# TYPE cohere_proxy_response_body_bytes histogram
+cohere_proxy_response_body_bytes_bucket{method="POST",le="10"} 0
+cohere_proxy_response_body_bytes_bucket{method="POST",le="100"} 0
+cohere_proxy_response_body_bytes_bucket{method="POST",le="1000"} 1
+cohere_proxy_response_body_bytes_bucket{method="POST",le="+Inf"} 1
+cohere_proxy_response_body_bytes_sum{method="POST"} 500
+cohere_proxy_response_body_bytes_count{method="POST"} 1
+`), "cohere_proxy_request_body_bytes", "cohere_proxy_response_body_bytes"))
+}
+
+func Test_Handler_Upstream_Latency_Excludes_Body(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// headers promptly, then a slow body.
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithMetricsRegistry(reg)))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	var count uint64
+	for _, family := range families {
+		if family.GetName() == "cohere_proxy_upstream_latency_seconds" {
+			for _, m := range family.GetMetric() {
+				sum += m.GetHistogram().GetSampleSum()
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	assert.Equal(t, count, uint64(1))
+	assert.Less(t, sum, 0.2)
+}
+
+func Test_Handler_Latency_By_Status_Class(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithMetricsRegistry(reg)))
+	defer frontendServer.Close()
+
+	for _, path := range []string{"/", "/", "/missing", "/broken", "/broken", "/broken"} {
+		resp, err := http.Get(frontendServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != "cohere_proxy_upstream_latency_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "status_class" {
+					observed[label.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	assert.Equal(t, observed, map[string]uint64{"2xx": 2, "4xx": 1, "5xx": 3})
+}
+
+func Test_Live_Server_Recovers_From_Panics(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	panicking := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/panic" {
+			panic("bad transport")
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	logs := &syncBuffer{}
+	srv := newLiveServer(t, targetUrl, internal.WithTransport(panicking), internal.WithLogger(log.New(logs, "", 0)))
+
+	resp, err := http.Get(srv.URL() + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusInternalServerError)
+	assert.Equal(t, string(b), `{"error":{"message":"the proxy failed to handle the request","type":"internal_error"}}`+"\n")
+	assert.Contains(t, logs.String(), "panic serving GET /panic: bad transport\ngoroutine ")
+
+	// the server carries on.
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+		assert.Equal(t, string(b), "reverse proxied")
+	}
+}
+
+func Test_Live_Server_Unix_Socket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions aren't supported on windows")
+	}
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "reverse proxied")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// leave a stale socket behind, as a crashed process would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := internal.NewServer(targetUrl)
+	if err := srv.Listen("unix://" + path); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Shutdown(context.Background())
+	assert.Equal(t, srv.URL(), "unix://"+path)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o660))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://proxy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(b), "reverse proxied")
+
+	// a socket in use isn't taken over.
+	assert.ErrorContains(t, internal.NewServer(targetUrl).Listen("unix://"+path), "in use by another process")
+}
+
+func Test_Handler_Replays_Idempotent_Requests(t *testing.T) {
+	var calls atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"generation":%d}`, n)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithIdempotency(time.Minute)))
+	defer frontendServer.Close()
+
+	post := func(key string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, frontendServer.URL+"/v1/generate", strings.NewReader(`{"prompt":"hi"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(internal.IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	first, body := post("key-1")
+	assert.Equal(t, first.StatusCode, http.StatusCreated)
+	assert.Equal(t, body, `{"generation":1}`)
+	assert.Empty(t, first.Header.Get(internal.IdempotentReplayedHeader))
+
+	replay, body := post("key-1")
+	assert.Equal(t, replay.StatusCode, http.StatusCreated)
+	assert.Equal(t, body, `{"generation":1}`)
+	assert.Equal(t, replay.Header.Get("Content-Type"), "application/json")
+	assert.Equal(t, replay.Header.Get(internal.IdempotentReplayedHeader), "true")
+	assert.Equal(t, calls.Load(), int32(1))
+
+	// a new key is a new request.
+	_, body = post("key-2")
+	assert.Equal(t, body, `{"generation":2}`)
+	assert.Equal(t, calls.Load(), int32(2))
+}
+
+func Test_Live_Server_Debug_Endpoints(t *testing.T) {
+	var forwarded atomic.Int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(u string) (int, string) {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	t.Run("alongside the proxy", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, internal.WithDebugEndpoints())
+		assert.Empty(t, srv.AdminURL())
+
+		status, body := get(srv.URL() + "/debug/vars")
+		assert.Equal(t, status, http.StatusOK)
+		assert.Contains(t, body, `"cmdline"`)
+
+		status, body = get(srv.URL() + "/debug/pprof/")
+		assert.Equal(t, status, http.StatusOK)
+		assert.Contains(t, body, "goroutine")
+		assert.Equal(t, forwarded.Load(), int32(0))
+	})
+
+	t.Run("on the admin address", func(t *testing.T) {
+		srv := newLiveServer(t, targetUrl, internal.WithDebugEndpoints(), internal.WithAdminAddress("127.0.0.1:0"))
+
+		status, body := get(srv.AdminURL() + "/debug/vars")
+		assert.Equal(t, status, http.StatusOK)
+		assert.Contains(t, body, `"cmdline"`)
+
+		// the proxy's listener neither serves nor forwards them.
+		status, _ = get(srv.URL() + "/debug/vars")
+		assert.Equal(t, status, http.StatusNotFound)
+		assert.Equal(t, forwarded.Load(), int32(0))
+
+		status, _ = get(srv.URL() + "/v1/generate")
+		assert.Equal(t, status, http.StatusOK)
+		assert.Equal(t, forwarded.Load(), int32(1))
+	})
+}
+
+func Test_Handler_Deadline_Hint(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(internal.DeadlineHintHeader))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []internal.Option
+		min, max int
+	}{
+		{"from the request deadline", []internal.Option{internal.WithRequestDeadline(2 * time.Second)}, 1500, 2000},
+		{"without a deadline", nil, -1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, append(tt.opts, internal.WithDeadlineHint())...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the client's own value is never trusted.
+			req.Header.Set(internal.DeadlineHintHeader, "999999")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.min < 0 {
+				assert.Empty(t, string(b))
+				return
+			}
+			var ms int
+			if _, err := fmt.Sscan(string(b), &ms); err != nil {
+				t.Fatal(err)
+			}
+			assert.GreaterOrEqual(t, ms, tt.min)
+			assert.LessOrEqual(t, ms, tt.max)
+		})
+	}
+}
+
+func Test_Handler_Shadows_Requests(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer backendServer.Close()
+
+	shadowed := make(chan string, 1)
+	release := make(chan struct{})
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		shadowed <- r.Method + " " + r.URL.Path + " " + string(b)
+		// a stuck shadow mustn't hold up the client.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer shadowServer.Close()
+	defer close(release)
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithBufferedBody(1024),
+		internal.WithShadow(shadowUrl, 1),
+		internal.WithShadowTimeout(100*time.Millisecond),
+		internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	))
+	defer frontendServer.Close()
+
+	resp, err := http.Post(frontendServer.URL+"/v1/generate", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "primary", string(b))
+
+	select {
+	case got := <-shadowed:
+		assert.Equal(t, `POST /v1/generate {"prompt":"hi"}`, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't shadowed")
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), `"msg":"shadow request failed"`)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, logs.String(), `"level":"DEBUG"`)
+}
+
+func Test_Handler_Tees_Unbuffered_Bodies_To_The_Shadow(t *testing.T) {
+	const size = 64 << 20
+
+	digest := func(r io.Reader) string {
+		h := sha256.New()
+		io.Copy(h, r)
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+	primary := make(chan string, 1)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primary <- digest(r.Body)
+	}))
+	defer backendServer.Close()
+
+	shadowed := make(chan string, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowed <- digest(r.Body)
+	}))
+	defer shadowServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithShadow(shadowUrl, 1)))
+	defer frontendServer.Close()
+
+	// sample the heap while the body streams through both upstreams.
+	var baseline runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&baseline)
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak.Load() {
+				peak.Store(m.HeapAlloc)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	sent := sha256.New()
+	body := io.TeeReader(io.LimitReader(mathrand.New(mathrand.NewSource(1)), size), sent)
+	resp, err := http.Post(frontendServer.URL+"/v1/upload", "application/octet-stream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := fmt.Sprintf("%x", sent.Sum(nil))
+	assert.Equal(t, want, <-primary)
+	select {
+	case got := <-shadowed:
+		assert.Equal(t, want, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't shadowed")
+	}
+	close(done)
+	<-sampled
+	// neither copy held anything like the whole body.
+	assert.Less(t, peak.Load()-min(peak.Load(), baseline.HeapAlloc), uint64(size/2))
+}
+
+func Test_Handler_Cuts_Off_Stalled_Shadow_Tees(t *testing.T) {
+	const size = 64 << 20
+
+	primary := make(chan int64, 1)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		primary <- n
+	}))
+	defer backendServer.Close()
+
+	release := make(chan struct{})
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never reads the body.
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer shadowServer.Close()
+	defer close(release)
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl, internal.WithShadow(shadowUrl, 1)))
+	defer frontendServer.Close()
+
+	start := time.Now()
+	resp, err := http.Post(frontendServer.URL+"/v1/upload", "application/octet-stream", io.LimitReader(mathrand.New(mathrand.NewSource(1)), size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, <-primary, int64(size))
+	// held up for a moment at most, not until the shadow gives up.
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func Test_Handler_Shadows_Requests_Matching_Rules(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backendServer.Close()
+
+	var mu sync.Mutex
+	shadowed := map[string]bool{}
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		shadowed[r.URL.Query().Get("name")] = true
+	}))
+	defer shadowServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithShadow(shadowUrl, 0),
+		internal.WithShadowRule(internal.ShadowRule{PathPrefix: "/v1/chat", Fraction: 1}),
+		internal.WithShadowRule(internal.ShadowRule{Header: "X-Tenant", HeaderValue: "beta", Fraction: 1}),
+		internal.WithShadowRule(internal.ShadowRule{ClientCIDRs: []string{"203.0.113.0/24"}, Fraction: 1}),
+		internal.WithShadowRule(internal.ShadowRule{PathPrefix: "/v1/embed", Fraction: 0}),
+		internal.WithTrustedProxies([]string{"127.0.0.0/8"}),
+	))
+	defer frontendServer.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		client   string
+		shadowed bool
+	}{
+		{"matching path", "/v1/chat", "", "", true},
+		{"other path", "/v1/generate", "", "", false},
+		{"matching header", "/v1/generate", "beta", "", true},
+		{"other header value", "/v1/generate", "stable", "", false},
+		{"matching client", "/v1/generate", "", "203.0.113.7", true},
+		{"other client", "/v1/generate", "", "198.51.100.7", false},
+		{"zero fraction", "/v1/embed", "", "", false},
+	}
+
+	want := map[string]bool{}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, frontendServer.URL+tt.path+"?name="+url.QueryEscape(tt.name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set("X-Tenant", tt.header)
+		}
+		if tt.client != "" {
+			req.Header.Set("X-Forwarded-For", tt.client)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if tt.shadowed {
+			want[tt.name] = true
+		}
+	}
+
+	got := func() map[string]bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(shadowed)
+	}
+	assert.Eventually(t, func() bool { return len(got()) >= len(want) }, 5*time.Second, 10*time.Millisecond)
+	// give any wrongly shadowed requests time to arrive too.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, want, got())
+}
+
+func Test_Handler_Correlates_Shadow_Requests(t *testing.T) {
+	primaryIDs := make(chan string, 1)
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryIDs <- r.Header.Get(internal.ShadowIDHeader)
+	}))
+	defer backendServer.Close()
+
+	shadowIDs := make(chan string, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowIDs <- r.Header.Get(internal.ShadowIDHeader)
+	}))
+	defer shadowServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithShadow(shadowUrl, 1),
+		internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	))
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL+"/v1/models", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clients can't choose the ID.
+	req.Header.Set(internal.ShadowIDHeader, "spoofed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	id := <-primaryIDs
+	assert.NotEmpty(t, id)
+	assert.NotEqual(t, "spoofed", id)
+	assert.Equal(t, id, <-shadowIDs)
+
+	type entry struct {
+		Msg      string
+		Path     string
+		Status   int
+		ShadowID string `json:"shadow_id"`
+	}
+	entries := func() map[string]entry {
+		found := map[string]entry{}
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var e entry
+			if json.Unmarshal([]byte(line), &e) == nil {
+				found[e.Msg] = e
+			}
+		}
+		return found
+	}
+	assert.Eventually(t, func() bool { return len(entries()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	found := entries()
+	assert.Equal(t, entry{"request", "/v1/models", http.StatusOK, id}, found["request"])
+	assert.Equal(t, entry{"shadow request", "/v1/models", http.StatusOK, id}, found["shadow request"])
+}
+
+func Test_Handler_Keeps_Shadow_Errors_Out_Of_The_Log(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer backendServer.Close()
+
+	shadowed := make(chan struct{}, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "shadow exploded")
+		shadowed <- struct{}{}
+	}))
+	defer shadowServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithShadow(shadowUrl, 1),
+		internal.WithErrorBodyLogging(1024),
+		internal.WithLogger(log.New(logs, "", 0)),
+	))
+	defer frontendServer.Close()
+
+	resp, err := http.Get(frontendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-shadowed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't shadowed")
+	}
+	assert.Never(t, func() bool {
+		return strings.Contains(logs.String(), "shadow exploded")
+	}, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func Test_Proxy_Strips_Configured_Query_Params(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, internal.WithStripQueryParams("api_key")))
+	defer frontendServer.Close()
+
+	tests := []struct {
+		query, want string
+	}{
+		{"?model=command&api_key=hunter2&stream=true", "/v1/chat?model=command&stream=true"},
+		{"?api_key=a&api_key=b", "/v1/chat"},
+		{"?API_KEY=x", "/v1/chat?API_KEY=x"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(frontendServer.URL + "/v1/chat" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.want, string(b), tt.query)
+	}
+}
+
+func Test_Proxy_Routes_To_Canary(t *testing.T) {
+	var primaryHits, canaryHits int32
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryHits, 1)
+		fmt.Fprint(w, "primary")
+	}))
+	defer backendServer.Close()
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&canaryHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer canaryServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canaryUrl, err := url.Parse(canaryServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, proxy http.Handler, header string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if header != "" {
+			req.Header.Set("X-Canary", header)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	t.Run("by header", func(t *testing.T) {
+		proxy := internal.NewProxy(targetUrl, internal.WithCanary(canaryUrl, 0), internal.WithCanaryHeader("X-Canary", "always"))
+
+		resp := get(t, proxy, "always")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "canary", resp.Header.Get(internal.ProxyUpstreamHeader))
+
+		resp = get(t, proxy, "never")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "primary", resp.Header.Get(internal.ProxyUpstreamHeader))
+	})
+
+	t.Run("by empty header", func(t *testing.T) {
+		proxy := internal.NewProxy(targetUrl, internal.WithCanary(canaryUrl, 0), internal.WithCanaryHeader("X-Canary", ""))
+
+		// only requests sending the header, not every one without it.
+		resp := get(t, proxy, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "primary", resp.Header.Get(internal.ProxyUpstreamHeader))
+
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.Header.Set("X-Canary", "")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		assert.Equal(t, "canary", rec.Result().Header.Get(internal.ProxyUpstreamHeader))
+	})
+
+	t.Run("by fraction, stable across retries", func(t *testing.T) {
+		atomic.StoreInt32(&primaryHits, 0)
+		atomic.StoreInt32(&canaryHits, 0)
+		proxy := internal.NewProxy(targetUrl, internal.WithCanary(canaryUrl, 0.5), internal.WithRetry(3, time.Millisecond))
+
+		served := map[string]int32{}
+		for i := 0; i < 40; i++ {
+			resp := get(t, proxy, "")
+			upstream := resp.Header.Get(internal.ProxyUpstreamHeader)
+			served[upstream]++
+			if upstream == "canary" {
+				assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}
+		assert.Len(t, served, 2)
+		// retries of canary requests never fall back to the primary.
+		assert.Equal(t, served["primary"], atomic.LoadInt32(&primaryHits))
+		assert.Equal(t, 3*served["canary"], atomic.LoadInt32(&canaryHits))
+	})
+
+	t.Run("without a canary", func(t *testing.T) {
+		resp := get(t, internal.NewProxy(targetUrl), "")
+		assert.Empty(t, resp.Header.Get(internal.ProxyUpstreamHeader))
+	})
+}
+
+func Test_Handler_Traces_Requests(t *testing.T) {
+	streaming := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: hi\n\n")
+			w.(http.Flusher).Flush()
+			close(streaming)
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, r.Header.Get("Traceparent"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := tracetest.NewSpanRecorder()
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithTracing(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))),
+	))
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL+"/v1/models", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// continues the client's trace.
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the span ends just after the response does.
+	if !assert.Eventually(t, func() bool { return len(spans.Ended()) == 1 }, 5*time.Second, 10*time.Millisecond) {
+		return
+	}
+	span := spans.Ended()[0]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+	assert.Equal(t, fmt.Sprintf("00-%s-%s-01", span.SpanContext().TraceID(), span.SpanContext().SpanID()), string(b))
+	// the client is told the same, to correlate its own traces.
+	assert.Equal(t, string(b), resp.Header.Get("Traceparent"))
+
+	// without tracing, the client's traceparent isn't just echoed back.
+	untraced := httptest.NewServer(internal.NewHandler(targetUrl))
+	defer untraced.Close()
+	req, err = http.NewRequest(http.MethodGet, untraced.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	untracedResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untracedResp.Body.Close()
+	assert.Empty(t, untracedResp.Header.Get("Traceparent"))
+
+	attrs := map[string]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value
+	}
+	assert.Equal(t, int64(200), attrs["http.response.status_code"].AsInt64())
+	assert.Equal(t, int64(200), attrs["proxy.upstream.status_code"].AsInt64())
+	assert.Contains(t, attrs, "proxy.upstream.duration_ms")
+
+	// a client hanging up mid-stream still ends its span.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, frontendServer.URL+"/v1/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-streaming
+	cancel()
+	resp.Body.Close()
+
+	assert.Eventually(t, func() bool { return len(spans.Ended()) == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_Live_Server_Watchdog_Kills_Stuck_Requests(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	logs := &syncBuffer{}
+	srv := newLiveServer(t, targetUrl,
+		internal.WithLogger(log.New(logs, "", 0)),
+		internal.WithWatchdog(200*time.Millisecond),
+		// ignores its context, and every timeout with it.
+		internal.WithFeature("stuck", func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+		}),
+	)
+	// let the stuck handler go before the server shuts down.
+	defer close(release)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(internal.FeatureHeader, "stuck")
+
+	start := time.Now()
+	_, err = http.DefaultClient.Do(req)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, logs.String(), "watchdog: killing GET / after 200ms")
+
+	// requests that finish in time are untouched.
+	resp, err := http.Get(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_Proxy_Merges_Split_Forwarded_For(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Header.Values("X-Forwarded-For"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []internal.Option
+		want string
+	}{
+		{"from a trusted proxy", []internal.Option{internal.WithTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})}, `["203.0.113.7, 10.0.0.2, 10.0.0.3, 127.0.0.1"]`},
+		{"from anyone else", nil, `["127.0.0.1"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frontendServer := httptest.NewServer(internal.NewProxy(targetUrl, tt.opts...))
+			defer frontendServer.Close()
+
+			req, err := http.NewRequest(http.MethodGet, frontendServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+			req.Header.Add("X-Forwarded-For", " ,10.0.0.3")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, string(b))
+		})
+	}
+}
+
+func Test_Handler_Real_Client_Behind_Trusted_Proxies(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &syncBuffer{}
+	handler := internal.NewHandler(targetUrl,
+		internal.WithTrustedProxies([]string{"127.0.0.1"}),
+		internal.WithRateLimit(0.5, 1),
+		internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, nil))),
+	)
+
+	get := func(handler http.Handler, xff string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.RemoteAddr = "127.0.0.1:51234"
+		req.Header.Set("X-Forwarded-For", xff)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the client can put anything on the left; only what the trusted proxy saw counts.
+	rec := get(handler, "198.51.100.1, 203.0.113.7")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "203.0.113.7, 127.0.0.1", rec.Body.String())
+	assert.Contains(t, logs.String(), `"client":"203.0.113.7"`)
+
+	// so spoofing doesn't get it a fresh rate limit, but other clients have their own.
+	assert.Equal(t, http.StatusTooManyRequests, get(handler, "198.51.100.2, 203.0.113.7").Code)
+	assert.Equal(t, http.StatusOK, get(handler, "203.0.113.8").Code)
+
+	// from untrusted peers, the header is ignored altogether.
+	rec = get(internal.NewHandler(targetUrl, internal.WithAccessLog(slog.New(slog.NewJSONHandler(logs, nil)))), "203.0.113.9")
+	assert.Equal(t, "127.0.0.1", rec.Body.String())
+	assert.NotContains(t, logs.String(), "203.0.113.9")
+}
+
+func Test_Handler_Filters_Clients_By_CIDR(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := internal.NewHandler(targetUrl,
+		internal.WithTrustedProxies([]string{"10.0.0.1"}),
+		internal.WithAllowedCIDRs([]string{"203.0.113.0/24", "10.0.0.1"}),
+		internal.WithDeniedCIDRs([]string{"203.0.113.66"}),
+	)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		status     int
+	}{
+		{"allowed", "203.0.113.7:1234", "", http.StatusOK},
+		{"unlisted", "198.51.100.1:1234", "", http.StatusForbidden},
+		{"denied and allowed", "203.0.113.66:1234", "", http.StatusForbidden},
+		{"allowed behind a trusted proxy", "10.0.0.1:1234", "203.0.113.7", http.StatusOK},
+		{"unlisted behind a trusted proxy", "10.0.0.1:1234", "198.51.100.1", http.StatusForbidden},
+		{"denied behind a trusted proxy", "10.0.0.1:1234", "203.0.113.66", http.StatusForbidden},
+		{"spoofing from an untrusted peer", "198.51.100.1:1234", "203.0.113.7", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.status == http.StatusForbidden {
+				assert.JSONEq(t, `{"error":{"message":"requests from this address are not allowed","type":"forbidden"}}`, rec.Body.String())
+			}
+		})
+	}
+
+	// an invalid list rejects everyone rather than no one.
+	closed := internal.NewHandler(targetUrl, internal.WithLogger(log.New(io.Discard, "", 0)), internal.WithAllowedCIDRs([]string{"203.0.113.0/33"}))
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	rec := httptest.NewRecorder()
+	closed.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Error(t, internal.NewConfig(internal.WithAllowedCIDRs([]string{"203.0.113.0/33"})).Validate())
+}
+
+func Test_Live_Server_Filters_Clients_On_Local_Routes(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backendServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newLiveServer(t, targetUrl,
+		internal.WithDeniedCIDRs([]string{"127.0.0.0/8"}),
+		internal.WithDebugEndpoints(),
+		internal.WithMetricsRegistry(prometheus.NewRegistry()),
+	)
+
+	for _, path := range []string{"/", "/debug/pprof/", internal.MetricsPath, "/healthz"} {
+		resp, err := http.Get(srv.URL() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, path)
+	}
+}
+
+func Test_Handler_Strips_Shadow_Requests(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "primary")
+	}))
+	defer backendServer.Close()
+
+	shadowed := make(chan string, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowed <- fmt.Sprintf("secret=%q auth=%q uri=%s", r.Header.Get("X-Internal-Secret"), r.Header.Get("Authorization"), r.URL.RequestURI())
+	}))
+	defer shadowServer.Close()
+
+	targetUrl, err := url.Parse(backendServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadowUrl, err := url.Parse(shadowServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontendServer := httptest.NewServer(internal.NewHandler(targetUrl,
+		internal.WithShadow(shadowUrl, 1),
+		internal.WithStripRequestHeaders("X-Internal-Secret"),
+		internal.WithStripQueryParams("api_key"),
+		internal.WithAPIKey("upstream-key"),
+	))
+	defer frontendServer.Close()
+
+	req, err := http.NewRequest(http.MethodGet, frontendServer.URL+"/v1/models?api_key=hunter2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Internal-Secret", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	select {
+	case got := <-shadowed:
+		assert.Equal(t, `secret="" auth="Bearer upstream-key" uri=/v1/models`, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't shadowed")
+	}
+}